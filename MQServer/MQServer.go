@@ -2,16 +2,16 @@ package MQServer
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"go-rabbitmq-consumers/logger"
 	"go-rabbitmq-consumers/utils"
+	"sync"
 	"time"
 
 	"go-rabbitmq-consumers/db"
 	"go-rabbitmq-consumers/models"
+	"go-rabbitmq-consumers/scheduler"
 
 	"github.com/streadway/amqp"
 )
@@ -28,6 +28,8 @@ type RabbitMQServer struct {
 	Consumer     *models.ConsumerParams
 	DoError      ErrorHandler
 	DoSuccess    SuccessHandler
+
+	receiving sync.WaitGroup // 消费协程
 }
 
 type ErrorHandler func(queueData string, consumer *models.ConsumerParams)
@@ -97,52 +99,39 @@ func (mq *RabbitMQServer) Connect(vhost string) bool {
 	return true
 }
 
+// StopConsumer stops receiving and waits for the deliveries in flight to be
+// settled before it closes the connection.
 func (mq *RabbitMQServer) StopConsumer() {
-	mq.Connnection.Close()
 	mq.Stop()
+	mq.receiving.Wait()
+	mq.Connnection.Close()
+	if mq.Consumer != nil {
+		utils.SetConsumerRateLimit(mq.Consumer.Id, models.RateLimit{})
+		utils.RemoveConsumerHttpClient(mq.Consumer.Id)
+		utils.RemoveConsumerGrpcConns(mq.Consumer.Id)
+		utils.RemoveConsumerLanes(mq.Consumer.Id)
+		utils.RemoveConsumerAmqpSinks(mq.Consumer.Id)
+	}
 }
 
-func (mq *RabbitMQServer) validateCallbackResult(queuedata string, responseBody string, status_code int) {
-	var (
-		err         error
-		cb_data     models.CallbackData
-		bErrorFound bool
-	)
-	cb_data = models.CallbackData{}
-
-	if err = json.Unmarshal([]byte(responseBody), &cb_data); err != nil {
-		logger.E("validateCallbackResult", err.Error())
+// validateCallbackResult hands a failed callback to the durable retry scheduler.
+func (mq *RabbitMQServer) validateCallbackResult(params *models.ConsumerParams, failed models.FailedCallback, result utils.RuleResult) {
+	if result.Success {
+		return
 	}
+	logger.I("validateCallbackResult", fmt.Sprintf("callback failed. queue_name:%s, rule:%s, reason:%s", params.QueueName, result.Rule, result.Reason))
 
-	if status_code != 200 {
-		bErrorFound = true
-	} else {
-		if cb_data.ErrorCode == 0 && err == nil {
-			return
-		} else {
-			bErrorFound = true
+	if result.Permanent {
+		if err := db.SaveFailedRequest(failed); err != nil {
+			logger.E("validateCallbackResult", "Failed to save failed request", err.Error())
 		}
+		return
 	}
 
-	if bErrorFound {
-		retryIntervals := []time.Duration{5 * time.Second, 1 * time.Minute, 5 * time.Minute}
-		for _, interval := range retryIntervals {
-			time.Sleep(interval)
-			body, retryErr, retryStatusCode := utils.HttpRequest(utils.HTTP_POST, nil, mq.Consumer.Callback, queuedata)
-			if retryErr == nil && retryStatusCode == 200 {
-				var retryCbData models.CallbackData
-				if json.Unmarshal([]byte(body), &retryCbData) == nil && retryCbData.ErrorCode == 0 {
-					return // Retry successful
-				}
-			}
-			responseBody = body           // Update responseBody with the latest retry response
-			status_code = retryStatusCode // Update status_code with the latest retry status
-		}
-
-		// All retries failed, save to database
-		if err := db.SaveFailedRequest(mq.Consumer.Callback, queuedata, responseBody, status_code, mq.Consumer.QueueName); err != nil {
+	if err := scheduler.Enqueue(params, failed); err != nil {
+		logger.E("validateCallbackResult", "Failed to enqueue retry job", err.Error())
+		if err = db.SaveFailedRequest(failed); err != nil {
 			logger.E("validateCallbackResult", "Failed to save failed request", err.Error())
-			return
 		}
 	}
 }
@@ -161,11 +150,7 @@ func (mq *RabbitMQServer) StartConsumer(params *models.ConsumerParams) error {
 	if err != nil {
 		return err
 	}
-	if params.Qos == 0 {
-		ch.Qos(1, 0, false)
-	} else {
-		ch.Qos(params.Qos, 0, false)
-	}
+	ch.Qos(prefetchCount(params), 0, false)
 
 	if err = ch.ExchangeDeclare(params.ExchangeName, "topic", true, false, false, false, nil); err != nil {
 		return err
@@ -181,21 +166,20 @@ func (mq *RabbitMQServer) StartConsumer(params *models.ConsumerParams) error {
 		return err
 	}
 
-	msg, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	consumerTag := "rch-" + utils.GetUUID()
+	msg, err := ch.Consume(q.Name, consumerTag, false, false, false, false, nil)
 	if err != nil {
 		return err
 	}
 
 	mq.Consumer = params
+	utils.SetConsumerRateLimit(params.Id, params.RateLimit)
+	utils.SetCallbackBreaker(params.Callback, params.CircuitBreaker)
 
+	mq.receiving.Add(1)
 	go func() {
-		var (
-			queue_data string
-			body       string
-			tmp_data   []byte
-			err        error
-			statusCode int
-		)
+		var err error
+		defer mq.receiving.Done()
 		defer func() {
 			logger.I("Close", "queuename:", mq.Consumer.QueueName)
 			if err = ch.Close(); err != nil {
@@ -207,34 +191,23 @@ func (mq *RabbitMQServer) StartConsumer(params *models.ConsumerParams) error {
 		}()
 
 		for {
-			select {
-			case <-mq.StopCtx.Done():
+			ctx, pause := context.WithCancel(mq.StopCtx)
+			if utils.BatchEnabled(params.Batch) {
+				mq.receiveBatches(ctx, pause, ch, params, msg)
+			} else {
+				mq.receive(ctx, pause, ch, params, msg)
+			}
+			paused := ctx.Err() != nil && mq.StopCtx.Err() == nil
+			pause()
+			if !paused {
 				return
-			case data := <-msg:
-				// fmt.Println("msg:", string(data.Body), "callback:", params.Callback, data.Headers["vinehoo-retry-id"])
-				if mq.Connnection.IsClosed() {
-					return
-				}
+			}
 
-				// receive_time := primitive.NewDateTimeFromTime(time.Now().Add(time.Hour * 8))
-				queue_data = string(data.Body)
-				if params.AutoDecodeBase64 {
-					tmp_data, err = base64.StdEncoding.DecodeString(queue_data)
-					queue_data = string(tmp_data)
-					if err != nil {
-						logger.I("Decodebase64", err.Error())
-						fmt.Println(err)
-					}
+			if msg, err = mq.pauseConsumer(ch, q.Name, consumerTag, params, msg); err != nil {
+				if mq.StopCtx.Err() == nil {
+					logger.E("pauseConsumer", err.Error())
 				}
-
-				logger.I("Consumer", fmt.Sprintf("id:%s, queue_name:%s, callback:%s, data:%s", params.Id, params.Name, params.Callback, queue_data))
-
-				body, err, statusCode = utils.HttpRequest(utils.HTTP_POST, nil, params.Callback, queue_data)
-
-				logger.I("Callback", fmt.Sprintf("%s return:%s", params.Callback, body))
-				go mq.validateCallbackResult(queue_data, body, statusCode)
-
-				ch.Ack(data.DeliveryTag, false)
+				return
 			}
 		}
 	}()
@@ -262,5 +235,17 @@ func (mq *RabbitMQServer) DeleteQueue() error {
 		_, err = ch.QueueDelete(mq.Consumer.DeathQueue.QueueName, false, false, false)
 	}
 
+	if err == nil && mq.Consumer.RetryMode == models.RETRY_MODE_TTL_QUEUE {
+		for attempt := 1; ; attempt++ {
+			delay, ok := queueRetryDelay(mq.Consumer.RetryPolicy, attempt)
+			if !ok {
+				break
+			}
+			if _, err = ch.QueueDelete(retryQueueName(mq.Consumer.QueueName, delay), false, false, false); err != nil {
+				break
+			}
+		}
+	}
+
 	return err
 }
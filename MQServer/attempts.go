@@ -0,0 +1,145 @@
+package MQServer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"go-rabbitmq-consumers/db"
+	"go-rabbitmq-consumers/logger"
+	"go-rabbitmq-consumers/models"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// attempt is one delivery of a message. A message the broker delivers for
+// the first time is on its first attempt, so copies of it and other messages
+// with the same key never share a count. Deliveries after a failed callback
+// are counted per message in the attempts store, which survives requeues and
+// restarts; a redelivery after an open breaker or a stop does not add to it.
+// Consumers that never look at the count leave it untracked. The methods do
+// nothing on a nil attempt.
+type attempt struct {
+	consumerID string
+	key        string
+	n          int
+	firstAt    time.Time
+	// counted is set when the delivery was added to the attempts store.
+	counted bool
+}
+
+// tracksAttempts tells whether a consumer needs the delivery count of its
+// messages.
+func tracksAttempts(params *models.ConsumerParams) bool {
+	return params.DeliveryMode == models.DELIVERY_AT_LEAST_ONCE || params.Dedupe.Source != "" || params.Quarantine.MaxAttempts > 0
+}
+
+// messageKey identifies a message across its deliveries: by its message id,
+// or else by the hash of its routing key and body.
+func messageKey(data amqp.Delivery) string {
+	if data.MessageId != "" {
+		return "id:" + data.MessageId
+	}
+	h := sha256.New()
+	h.Write([]byte(data.RoutingKey))
+	h.Write([]byte{0})
+	h.Write(data.Body)
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// beginAttempt counts a delivery of a message that is about to be handled.
+// Only redeliveries go through the attempts store; when the store fails the
+// delivery counts as the first one.
+func beginAttempt(params *models.ConsumerParams, data amqp.Delivery) *attempt {
+	if !tracksAttempts(params) {
+		return nil
+	}
+
+	a := &attempt{consumerID: params.Id, key: messageKey(data), n: 1, firstAt: time.Now()}
+	if !data.Redelivered {
+		return a
+	}
+	n, firstAt, err := db.AddDeliveryAttempt(db.DB, a.consumerID, a.key, a.firstAt)
+	if err != nil {
+		logger.E("beginAttempt", "failed to count delivery attempt.", err.Error())
+		return a
+	}
+	a.n, a.firstAt, a.counted = n, firstAt, true
+	return a
+}
+
+// number is the count of this delivery, 1 for the first one.
+func (a *attempt) number() int {
+	if a == nil {
+		return 1
+	}
+	return a.n
+}
+
+// since is how long ago the first delivery started.
+func (a *attempt) since() time.Duration {
+	if a == nil {
+		return 0
+	}
+	return time.Since(a.firstAt)
+}
+
+// undo takes the delivery back when the message goes back to the queue
+// before it reached a callback.
+func (a *attempt) undo() {
+	if a == nil || !a.counted {
+		return
+	}
+	if err := db.UndoDeliveryAttempt(db.DB, a.consumerID, a.key); err != nil {
+		logger.E("undoAttempt", "failed to take back delivery attempt.", err.Error())
+	}
+}
+
+// failed keeps the count of a delivery whose callback failed, so the
+// redelivery of the message continues from it.
+func (a *attempt) failed() {
+	if a == nil {
+		return
+	}
+	if err := db.KeepDeliveryAttempts(db.DB, a.consumerID, a.key, a.n, a.firstAt); err != nil {
+		logger.E("failedAttempt", "failed to keep delivery attempts.", err.Error())
+	}
+}
+
+// done forgets the count once the message is settled for good.
+func (a *attempt) done() {
+	if a == nil {
+		return
+	}
+	if err := db.DeleteDeliveryAttempts(db.DB, a.consumerID, a.key); err != nil {
+		logger.E("doneAttempt", "failed to delete delivery attempts.", err.Error())
+	}
+}
+
+// requeueUnattempted hands a message back to the queue that did not reach a
+// callback. Its delivery and dedupe claim are taken back, so the next
+// delivery is not mistaken for a retry or a duplicate.
+func requeueUnattempted(params *models.ConsumerParams, data amqp.Delivery, metadata *models.MessageMetadata, queue_data string, a *attempt) {
+	a.undo()
+	releaseDedupe(params, metadata, queue_data)
+	data.Nack(false, true)
+}
+
+// requeueFailed hands a message back to the queue after its callback failed,
+// failed being one of its failed requests. The delivery counts as an attempt,
+// and the dedupe claim is given up so the redelivery is not mistaken for a
+// duplicate.
+func requeueFailed(params *models.ConsumerParams, data amqp.Delivery, failed models.FailedCallback, a *attempt) {
+	a.failed()
+	releaseDedupe(params, failed.Metadata, failed.RequestData)
+	data.Nack(false, true)
+}
+
+// DeliveryAttemptTTL is how long the count of a message that was never
+// settled is kept after its last delivery.
+const DeliveryAttemptTTL = 7 * 24 * time.Hour
+
+// CleanupDeliveryAttempts removes the counts of messages not seen for
+// DeliveryAttemptTTL.
+func CleanupDeliveryAttempts() (int64, error) {
+	return db.DeleteStaleDeliveryAttempts(db.DB, time.Now().Add(-DeliveryAttemptTTL))
+}
@@ -0,0 +1,166 @@
+package MQServer
+
+import (
+	"context"
+	"fmt"
+	"go-rabbitmq-consumers/logger"
+	"go-rabbitmq-consumers/models"
+	"go-rabbitmq-consumers/utils"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// receiveBatches collects deliveries into batches of up to params.Batch.Size
+// messages and delivers a batch once it is full or its timeout expires. It
+// returns once ctx is cancelled, after handing the deliveries it still holds
+// back to the queue, and pauses itself when the callback breaker opens.
+func (mq *RabbitMQServer) receiveBatches(ctx context.Context, pause context.CancelFunc, ch *amqp.Channel, params *models.ConsumerParams, msg <-chan amqp.Delivery) {
+	timeout := time.Duration(params.Batch.Timeout) * time.Millisecond
+	if params.Batch.Timeout == 0 {
+		timeout = utils.DEFAULT_BATCH_TIMEOUT * time.Millisecond
+	}
+
+	var (
+		batch []amqp.Delivery
+		flush <-chan time.Time
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			for _, data := range batch {
+				data.Nack(false, true)
+			}
+			return
+		case data, ok := <-msg:
+			if !ok || mq.closed() {
+				return
+			}
+			if len(batch) == 0 {
+				flush = time.After(timeout)
+			}
+			batch = append(batch, data)
+			if len(batch) < params.Batch.Size {
+				continue
+			}
+		case <-flush:
+		}
+
+		mq.deliverBatch(ch, params, batch)
+		batch, flush = nil, nil
+		if utils.CallbackBreaker(params).IsOpen() {
+			pause()
+		}
+	}
+}
+
+// deliverBatch sends a batch to the consumer callback as one JSON array. When
+// every item succeeded the whole batch is acked at once; otherwise each item is
+// settled on its own, so only the failed ones are retried or parked, and the
+// ones going back to the queue are held together.
+func (mq *RabbitMQServer) deliverBatch(ch *amqp.Channel, params *models.ConsumerParams, batch []amqp.Delivery) {
+	const FUNCNAME = "deliverBatch"
+
+	// Poison messages are quarantined and messages that fail to transform are
+	// parked on their own, filtered messages and duplicates are acked; all of
+	// them are left out.
+	transformed := batch[:0:0]
+	items := make([]models.FailedCallback, 0, len(batch))
+	bodies := make([]string, 0, len(batch))
+	attempts := make([]*attempt, 0, len(batch))
+	for _, data := range batch {
+		metadata := messageMetadata(data)
+		a := beginAttempt(params, data)
+		if quarantine(params, data, metadata, a) {
+			continue
+		}
+		queue_data, err := transformBody(params, data, metadata)
+		if err != nil {
+			if parkUntransformed(params, data, metadata, err) {
+				a.done()
+			}
+			continue
+		}
+		if filtered(params, metadata, queue_data) || duplicate(params, metadata, queue_data) {
+			a.done()
+			data.Ack(false)
+			continue
+		}
+
+		transformed = append(transformed, data)
+		attempts = append(attempts, a)
+		items = append(items, models.FailedCallback{
+			ConsumerId:  params.Id,
+			QueueName:   params.QueueName,
+			RequestURL:  params.Callback,
+			RequestData: queue_data,
+			Metadata:    metadata,
+		})
+		body, _ := utils.ApplyMetadata(params.MetadataMode, metadata, queue_data)
+		bodies = append(bodies, body)
+	}
+	if batch = transformed; len(batch) == 0 {
+		return
+	}
+
+	logger.I("Consumer", fmt.Sprintf("id:%s, queue_name:%s, callback:%s, batch:%d", params.Id, params.Name, utils.RedactURL(params.Callback), len(batch)))
+
+	breaker := utils.CallbackBreaker(params)
+	if utils.WaitRateLimit(mq.StopCtx, params.Id, params.Callback) != nil || !breaker.Acquire(mq.StopCtx) {
+		for i, data := range batch {
+			requeueUnattempted(params, data, items[i].Metadata, items[i].RequestData, attempts[i])
+		}
+		return
+	}
+
+	body, err, statusCode := utils.CallbackRequest(params, params.Callback, utils.BatchBody(bodies), nil)
+	if err != nil {
+		logger.E("Callback", fmt.Sprintf("%s failed:%s", utils.RedactURL(params.Callback), err.Error()))
+	}
+
+	logger.I("Callback", fmt.Sprintf("%s return:%s", utils.RedactURL(params.Callback), body))
+
+	results := utils.EvaluateBatch(params.SuccessCriteria, statusCode, body, len(batch))
+	// Items reported failed by a callback that answered do not count against
+	// the breaker; only a failure of the whole callback does.
+	breaker.Record(results[0].Success || results[0].Rule == utils.RULE_BATCH_ITEM)
+	failures := 0
+	for _, result := range results {
+		if !result.Success {
+			failures++
+		}
+	}
+	if failures == 0 {
+		for _, a := range attempts {
+			a.done()
+		}
+		batch[len(batch)-1].Ack(true)
+		return
+	}
+
+	// Items retried in place wait once, for the longest of their delays.
+	logger.I(FUNCNAME, fmt.Sprintf("%d of %d batch items failed. queue_name:%s", failures, len(batch), params.QueueName))
+	var (
+		retries []*heldRetry
+		delay   time.Duration
+	)
+	for i, data := range batch {
+		if results[i].Success {
+			attempts[i].done()
+			data.Ack(false)
+			continue
+		}
+		items[i].ResponseCode = statusCode
+		items[i].ResponseContent = body
+		items[i].Reason = results[i].Reason
+		if retry := mq.settleOrHold(ch, params, data, []outcome{{failed: items[i], result: results[i]}}, attempts[i]); retry != nil {
+			retries = append(retries, retry)
+			if retry.delay > delay {
+				delay = retry.delay
+			}
+		}
+	}
+	if len(retries) > 0 {
+		mq.requeueAfter(params, delay, retries)
+	}
+}
@@ -0,0 +1,33 @@
+package MQServer
+
+import (
+	"fmt"
+	"go-rabbitmq-consumers/logger"
+	"go-rabbitmq-consumers/models"
+	"go-rabbitmq-consumers/utils"
+
+	"github.com/streadway/amqp"
+)
+
+// pauseConsumer cancels the queue subscription while the callback breaker is
+// open, so new messages stay in the queue, and subscribes again once the
+// breaker lets probe requests through.
+func (mq *RabbitMQServer) pauseConsumer(ch *amqp.Channel, queue, consumerTag string, params *models.ConsumerParams, msg <-chan amqp.Delivery) (<-chan amqp.Delivery, error) {
+	const FUNCNAME = "pauseConsumer"
+
+	if err := ch.Cancel(consumerTag, false); err != nil {
+		return nil, err
+	}
+	// Hand back what the broker delivered before the cancel took effect.
+	for data := range msg {
+		data.Nack(false, true)
+	}
+	logger.I(FUNCNAME, fmt.Sprintf("callback circuit breaker open, consumer paused. id:%s, queue_name:%s", params.Id, params.QueueName))
+
+	if !utils.CallbackBreaker(params).WaitHalfOpen(mq.StopCtx) {
+		return nil, mq.StopCtx.Err()
+	}
+
+	logger.I(FUNCNAME, fmt.Sprintf("callback circuit breaker half-open, consumer resumed. id:%s, queue_name:%s", params.Id, params.QueueName))
+	return ch.Consume(queue, consumerTag, false, false, false, false, nil)
+}
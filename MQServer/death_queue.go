@@ -55,14 +55,7 @@ func CreateDeathQueue(config *models.RabbitMQConfig, vhost string, v map[string]
 
 	defer channel.Close()
 
-	_, err = channel.QueueDeclare(x_death_queue_name, true, false, false, false, amqp.Table{
-		"x-dead-letter-exchange":    x_dead_letter_exchange,
-		"x-dead-letter-routing-key": x_dead_letter_routing_key,
-		"x-message-ttl":             x_message_ttl.Milliseconds(),
-		"durable":                   true,
-	})
-
-	if err != nil {
+	if err = declareDelayQueue(channel, x_death_queue_name, x_message_ttl, x_dead_letter_exchange, x_dead_letter_routing_key); err != nil {
 		return err
 	}
 
@@ -73,3 +66,16 @@ func CreateDeathQueue(config *models.RabbitMQConfig, vhost string, v map[string]
 
 	return nil
 }
+
+// declareDelayQueue declares a durable queue whose messages expire after ttl and
+// are then dead-lettered to the given exchange and routing key.
+func declareDelayQueue(channel *amqp.Channel, name string, ttl time.Duration, dead_letter_exchange, dead_letter_routing_key string) error {
+	_, err := channel.QueueDeclare(name, true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange":    dead_letter_exchange,
+		"x-dead-letter-routing-key": dead_letter_routing_key,
+		"x-message-ttl":             ttl.Milliseconds(),
+		"durable":                   true,
+	})
+
+	return err
+}
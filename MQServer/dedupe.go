@@ -0,0 +1,51 @@
+package MQServer
+
+import (
+	"fmt"
+	"go-rabbitmq-consumers/db"
+	"go-rabbitmq-consumers/logger"
+	"go-rabbitmq-consumers/models"
+	"go-rabbitmq-consumers/utils"
+	"time"
+)
+
+// duplicate claims the dedupe key of a message and tells whether the key was
+// already seen within the consumer's window. A message going back to the
+// queue or to a retry queue gives up its claim first, so only the claim
+// decides. When the key store fails the message is delivered.
+func duplicate(params *models.ConsumerParams, metadata *models.MessageMetadata, queue_data string) bool {
+	const FUNCNAME = "duplicate"
+
+	key, ok := utils.DedupeKey(params.Dedupe, metadata, queue_data)
+	if !ok {
+		return false
+	}
+
+	now := time.Now()
+	claimed, err := db.ClaimDedupeKey(db.DB, params.Id, key, now, utils.DedupeWindow(params.Dedupe))
+	if err != nil {
+		logger.E(FUNCNAME, "failed to claim dedupe key.", err.Error())
+		return false
+	}
+	if claimed {
+		return false
+	}
+
+	logger.I(FUNCNAME, fmt.Sprintf("duplicate message acked. id:%s, queue_name:%s, key:%s", params.Id, params.QueueName, key))
+	if err := db.AddDedupeHit(db.DB, params.Id, now); err != nil {
+		logger.E(FUNCNAME, "failed to count dedupe hit.", err.Error())
+	}
+	return true
+}
+
+// releaseDedupe gives up the dedupe key of a message that goes back to the
+// queue before it reached a callback.
+func releaseDedupe(params *models.ConsumerParams, metadata *models.MessageMetadata, queue_data string) {
+	key, ok := utils.DedupeKey(params.Dedupe, metadata, queue_data)
+	if !ok {
+		return
+	}
+	if err := db.ReleaseDedupeKey(db.DB, params.Id, key); err != nil {
+		logger.E("releaseDedupe", "failed to release dedupe key.", err.Error())
+	}
+}
@@ -0,0 +1,423 @@
+package MQServer
+
+import (
+	"fmt"
+	"go-rabbitmq-consumers/db"
+	"go-rabbitmq-consumers/logger"
+	"go-rabbitmq-consumers/models"
+	"go-rabbitmq-consumers/scheduler"
+	"go-rabbitmq-consumers/utils"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// RETRY_HOLD_LIMIT is the longest retry delay a worker holds a message for
+// before it goes back to the queue.
+const RETRY_HOLD_LIMIT = 30 * time.Second
+
+// messageMetadata collects the AMQP properties forwarded to callbacks.
+func messageMetadata(data amqp.Delivery) *models.MessageMetadata {
+	metadata := &models.MessageMetadata{
+		RoutingKey:      data.RoutingKey,
+		Exchange:        data.Exchange,
+		MessageId:       data.MessageId,
+		CorrelationId:   data.CorrelationId,
+		Timestamp:       data.Timestamp,
+		Redelivered:     data.Redelivered,
+		Headers:         data.Headers,
+		ContentType:     data.ContentType,
+		ContentEncoding: data.ContentEncoding,
+	}
+
+	// Retry copies and released quarantined messages come through the default
+	// exchange and tell where they were first published.
+	if route, ok := data.Headers[HEADER_ORIGINAL_ROUTE].(amqp.Table); ok {
+		metadata.Exchange, _ = route["exchange"].(string)
+		metadata.RoutingKey, _ = route["routing_key"].(string)
+		metadata.Headers = make(map[string]interface{}, len(data.Headers))
+		for k, v := range data.Headers {
+			if k != HEADER_ORIGINAL_ROUTE {
+				metadata.Headers[k] = v
+			}
+		}
+	}
+	return metadata
+}
+
+// callback sends one message to a callback URL and returns the request and
+// its response in the shape kept by the failed store.
+func callback(params *models.ConsumerParams, url, queue_data string, metadata *models.MessageMetadata) models.FailedCallback {
+	request_body, headers := utils.ApplyMetadata(params.MetadataMode, metadata, queue_data)
+
+	body, err, statusCode := utils.SendCallback(params, url, request_body, headers, metadata)
+	if err != nil {
+		logger.E("Callback", fmt.Sprintf("%s failed:%s", utils.RedactURL(url), err.Error()))
+	}
+
+	logger.I("Callback", fmt.Sprintf("%s return:%s", utils.RedactURL(url), body))
+
+	return models.FailedCallback{
+		ConsumerId:      params.Id,
+		QueueName:       params.QueueName,
+		RequestURL:      url,
+		RequestData:     queue_data,
+		ResponseCode:    statusCode,
+		ResponseContent: body,
+		Metadata:        metadata,
+	}
+}
+
+// transformBody decodes a message body of the consumer's payload format and
+// runs it through the transform chain. The older auto_decode_base64 flag acts
+// as a base64 step in front of it.
+func transformBody(params *models.ConsumerParams, data amqp.Delivery, metadata *models.MessageMetadata) (string, error) {
+	steps := params.Transforms
+	if params.AutoDecodeBase64 {
+		steps = append([]models.TransformStep{{Type: models.TRANSFORM_BASE64_DECODE}}, steps...)
+	}
+
+	body, err := utils.ApplyTransforms(steps, params.Payload, data.Body, metadata)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// transformedBody is the outcome of transformBody for a message.
+type transformedBody struct {
+	queue_data string
+	err        error
+}
+
+// parkUntransformed stores a message whose transform failed in the failed
+// store, untouched and with the reason, instead of passing it to a callback.
+// It returns false when the message went back to the queue instead.
+func parkUntransformed(params *models.ConsumerParams, data amqp.Delivery, metadata *models.MessageMetadata, transformErr error) bool {
+	const FUNCNAME = "parkUntransformed"
+
+	logger.E(FUNCNAME, fmt.Sprintf("id:%s, queue_name:%s, %s", params.Id, params.QueueName, transformErr.Error()))
+	err := db.SaveFailedRequest(models.FailedCallback{
+		ConsumerId:  params.Id,
+		QueueName:   params.QueueName,
+		RequestURL:  params.Callback,
+		RequestData: string(data.Body),
+		Reason:      transformErr.Error(),
+		Metadata:    metadata,
+	})
+	if err != nil {
+		logger.E(FUNCNAME, "failed to save failed request, requeue message.", err.Error())
+		data.Nack(false, true)
+		return false
+	}
+	data.Ack(false)
+	return true
+}
+
+// route picks the callback targets of a message. The first matching routing
+// rule wins; other messages go to the consumer's default targets, or are
+// dropped when the consumer drops unrouted messages.
+func route(params *models.ConsumerParams, metadata *models.MessageMetadata, queue_data string) ([]models.CallbackTarget, bool) {
+	if rule, ok := utils.MatchRoute(params.RoutingRules, metadata, queue_data); ok {
+		return []models.CallbackTarget{{URL: rule.Callback, SuccessCriteria: params.SuccessCriteria}}, true
+	}
+	if params.DropUnrouted {
+		return nil, false
+	}
+	return utils.CallbackTargets(params), true
+}
+
+// outcome is the result of sending a message to one callback target.
+type outcome struct {
+	failed models.FailedCallback
+	result utils.RuleResult
+}
+
+// deliver hands one message to every callback target of the consumer and
+// settles it with the broker.
+func (mq *RabbitMQServer) deliver(ch *amqp.Channel, params *models.ConsumerParams, data amqp.Delivery) {
+	mq.deliverOnLane(ch, params, data, nil, nil)
+}
+
+// send delivers a message to one callback target and evaluates the response.
+func send(params *models.ConsumerParams, target models.CallbackTarget, queue_data string, metadata *models.MessageMetadata) outcome {
+	failed := callback(params, target.URL, queue_data, metadata)
+	result := utils.EvaluateResponse(params, target.SuccessCriteria, failed.ResponseCode, failed.ResponseContent)
+	failed.Reason = result.Reason
+	return outcome{failed: failed, result: result}
+}
+
+// deliverOnLane is deliver for a message on a partition lane, where failures
+// are retried in place before the message is settled. body is the message
+// body when it was transformed already, and lane is nil for consumers without
+// lanes.
+func (mq *RabbitMQServer) deliverOnLane(ch *amqp.Channel, params *models.ConsumerParams, data amqp.Delivery, body *transformedBody, lane *utils.Lane) {
+	metadata := messageMetadata(data)
+	a := beginAttempt(params, data)
+	if quarantine(params, data, metadata, a) {
+		return
+	}
+
+	if body == nil {
+		body = &transformedBody{}
+		body.queue_data, body.err = transformBody(params, data, metadata)
+	}
+	queue_data, err := body.queue_data, body.err
+	if err != nil {
+		if !parkUntransformed(params, data, metadata, err) {
+			return
+		}
+		a.done()
+		if rpcRequest(params, data) {
+			replyError(ch, data, rpcError{Error: err.Error(), Rule: utils.RULE_TRANSFORM})
+		}
+		return
+	}
+
+	logger.I("Consumer", fmt.Sprintf("id:%s, queue_name:%s, callback:%s, data:%s", params.Id, params.Name, utils.RedactURL(params.Callback), queue_data))
+
+	if filtered(params, metadata, queue_data) || duplicate(params, metadata, queue_data) {
+		a.done()
+		data.Ack(false)
+		return
+	}
+
+	targets, ok := route(params, metadata, queue_data)
+	if !ok {
+		logger.I("Consumer", fmt.Sprintf("no route matched, message dropped. id:%s, queue_name:%s, routing_key:%s", params.Id, params.QueueName, metadata.RoutingKey))
+		a.done()
+		data.Ack(false)
+		return
+	}
+
+	// Waiting here holds the worker, so intake slows down to the rate limit and
+	// the messages behind it stay in the queue. A stopped consumer hands the
+	// message back for redelivery.
+	if err := utils.WaitConsumerRateLimit(mq.StopCtx, params.Id); err != nil {
+		requeueUnattempted(params, data, metadata, queue_data, a)
+		return
+	}
+	for _, target := range targets {
+		if err := utils.WaitHostRateLimit(mq.StopCtx, target.URL); err != nil {
+			requeueUnattempted(params, data, metadata, queue_data, a)
+			return
+		}
+	}
+
+	// While the callback breaker is open the message goes back to the queue
+	// untouched and does not count as an attempt; the consumer pauses until the
+	// breaker lets probes through. Messages routed elsewhere do not go through
+	// the breaker.
+	var breaker *utils.Breaker
+	if targets[0].URL == params.Callback {
+		breaker = utils.CallbackBreaker(params)
+	}
+	if !breaker.Acquire(mq.StopCtx) {
+		requeueUnattempted(params, data, metadata, queue_data, a)
+		return
+	}
+
+	outcomes := make([]outcome, len(targets))
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target models.CallbackTarget) {
+			defer wg.Done()
+			outcomes[i] = send(params, target, queue_data, metadata)
+		}(i, target)
+	}
+	wg.Wait()
+
+	breaker.Record(outcomes[0].result.Success)
+	if lane != nil && !mq.retryOnLane(params, lane, targets, queue_data, metadata, outcomes) {
+		// Stopped while retrying: the message goes back to the queue for the
+		// next run.
+		requeueFailed(params, data, outcomes[0].failed, a)
+		return
+	}
+	mq.settle(ch, params, data, outcomes, a)
+}
+
+// settle acks, requeues or rejects a delivery after its callbacks, according
+// to the ack policy and the consumer's retry and delivery modes. Failed
+// targets are retried or parked one by one, so a later retry only goes to the
+// target that failed.
+func (mq *RabbitMQServer) settle(ch *amqp.Channel, params *models.ConsumerParams, data amqp.Delivery, outcomes []outcome, a *attempt) {
+	if retry := mq.settleOrHold(ch, params, data, outcomes, a); retry != nil {
+		mq.requeueAfter(params, retry.delay, []*heldRetry{retry})
+	}
+}
+
+// heldRetry is a delivery that goes back to the queue once its retry delay
+// is over.
+type heldRetry struct {
+	data   amqp.Delivery
+	failed models.FailedCallback
+	a      *attempt
+	delay  time.Duration
+}
+
+// settleOrHold is settle, except that a delivery to be retried after a delay
+// is returned instead of waited for, so deliveries settled together wait
+// only once.
+func (mq *RabbitMQServer) settleOrHold(ch *amqp.Channel, params *models.ConsumerParams, data amqp.Delivery, outcomes []outcome, a *attempt) *heldRetry {
+	const FUNCNAME = "settle"
+
+	results := make([]utils.RuleResult, len(outcomes))
+	failures := []models.FailedCallback{}
+	for i, o := range outcomes {
+		results[i] = o.result
+		if !o.result.Success {
+			failures = append(failures, o.failed)
+		}
+	}
+	result := utils.AckResult(params.AckPolicy, results)
+
+	// The message counts as delivered, the targets that failed anyway are
+	// retried in the background.
+	if result.Success {
+		for _, o := range outcomes {
+			mq.validateCallbackResult(params, o.failed, o.result)
+		}
+		reply(ch, params, data, outcomes, result)
+		a.done()
+		data.Ack(false)
+		return nil
+	}
+
+	// Retrying cannot fix a permanent failure, and a partition lane already
+	// retried in place: park it right away.
+	if permanent(outcomes) || utils.PartitionEnabled(params.Partition) {
+		if err := saveFailedRequests(failures); err != nil {
+			logger.E(FUNCNAME, "failed to save failed request, requeue message.", err.Error())
+			requeueFailed(params, data, failures[0], a)
+			return nil
+		}
+		logger.I(FUNCNAME, fmt.Sprintf("callback failed for good. queue_name:%s, rule:%s, reason:%s", params.QueueName, result.Rule, result.Reason))
+		reply(ch, params, data, outcomes, result)
+		a.done()
+		if params.DeliveryMode == models.DELIVERY_AT_LEAST_ONCE {
+			data.Reject(false)
+		} else {
+			data.Ack(false)
+		}
+		return nil
+	}
+
+	if params.RetryMode == models.RETRY_MODE_TTL_QUEUE {
+		mq.retryThroughQueue(ch, params, data, failures, a)
+		return nil
+	}
+
+	if params.DeliveryMode != models.DELIVERY_AT_LEAST_ONCE {
+		// The caller already has its error reply, a later retry would go unseen.
+		if rpcRequest(params, data) {
+			if err := saveFailedRequests(failures); err != nil {
+				logger.E(FUNCNAME, "failed to save failed request", err.Error())
+			}
+			reply(ch, params, data, outcomes, result)
+			a.done()
+			data.Ack(false)
+			return nil
+		}
+		for _, o := range outcomes {
+			mq.validateCallbackResult(params, o.failed, o.result)
+		}
+		a.done()
+		data.Ack(false)
+		return nil
+	}
+
+	// Retry through the broker while the retry policy allows it. Only
+	// deliveries that reached a callback count as attempts. The worker holds
+	// the message for a short delay, so the retry does not come back at once;
+	// a longer one would block the worker and the prefetch, and run into the
+	// broker's consumer timeout, so the retry scheduler takes over instead.
+	if delay, ok := utils.RetryDelay(params.RetryPolicy, a.number(), a.since()); ok {
+		if delay > RETRY_HOLD_LIMIT {
+			mq.scheduleRetry(ch, params, data, outcomes, result, a, delay)
+			return nil
+		}
+		logger.I(FUNCNAME, fmt.Sprintf("callback failed, requeue message in %s. queue_name:%s, attempt:%d, rule:%s, reason:%s", delay, params.QueueName, a.number(), result.Rule, result.Reason))
+		return &heldRetry{data: data, failed: failures[0], a: a, delay: delay}
+	}
+
+	// The retries are exhausted. Park it in the failed store before rejecting it,
+	// so it is never dropped; a dead-letter policy on the queue receives it too.
+	if err := saveFailedRequests(failures); err != nil {
+		logger.E(FUNCNAME, "failed to save failed request, requeue message.", err.Error())
+		requeueFailed(params, data, failures[0], a)
+		return nil
+	}
+
+	logger.I(FUNCNAME, fmt.Sprintf("retries exhausted, reject message. queue_name:%s, rule:%s, reason:%s", params.QueueName, result.Rule, result.Reason))
+	reply(ch, params, data, outcomes, result)
+	a.done()
+	data.Reject(false)
+	return nil
+}
+
+// requeueAfter holds the retries for delay, or until the consumer stops, and
+// then hands them back to the queue.
+func (mq *RabbitMQServer) requeueAfter(params *models.ConsumerParams, delay time.Duration, retries []*heldRetry) {
+	timer := time.NewTimer(delay)
+	select {
+	case <-timer.C:
+	case <-mq.StopCtx.Done():
+		timer.Stop()
+	}
+	for _, r := range retries {
+		requeueFailed(params, r.data, r.failed, r.a)
+	}
+}
+
+// scheduleRetry hands the failed callbacks of a message to the retry
+// scheduler, which retries them after delay, and acks the message. An RPC
+// caller gets its error reply now, since the retries go on without the
+// message.
+func (mq *RabbitMQServer) scheduleRetry(ch *amqp.Channel, params *models.ConsumerParams, data amqp.Delivery, outcomes []outcome, result utils.RuleResult, a *attempt, delay time.Duration) {
+	const FUNCNAME = "scheduleRetry"
+
+	firstFailedAt := time.Now().Add(-a.since())
+	for _, o := range outcomes {
+		if o.result.Success {
+			continue
+		}
+		if err := scheduler.Schedule(params, o.failed, a.number(), firstFailedAt, delay); err != nil {
+			logger.E(FUNCNAME, "failed to schedule retry, requeue message.", err.Error())
+			requeueFailed(params, data, o.failed, a)
+			return
+		}
+	}
+
+	logger.I(FUNCNAME, fmt.Sprintf("callback failed, retry scheduled in %s. queue_name:%s, attempt:%d, rule:%s, reason:%s", delay, params.QueueName, a.number(), result.Rule, result.Reason))
+	if rpcRequest(params, data) {
+		reply(ch, params, data, outcomes, result)
+	}
+	a.done()
+	data.Ack(false)
+}
+
+// permanent tells whether every failed target of a message failed
+// permanently.
+func permanent(outcomes []outcome) bool {
+	for _, o := range outcomes {
+		if !o.result.Success && !o.result.Permanent {
+			return false
+		}
+	}
+	return true
+}
+
+// saveFailedRequests parks the failed target callbacks of one message in the
+// failed store.
+func saveFailedRequests(failures []models.FailedCallback) error {
+	for _, failed := range failures {
+		if err := db.SaveFailedRequest(failed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package MQServer
+
+import (
+	"fmt"
+	"go-rabbitmq-consumers/logger"
+	"go-rabbitmq-consumers/models"
+	"go-rabbitmq-consumers/utils"
+)
+
+// filtered tells whether the consumer's filter keeps a message from its
+// callback, and counts it when it does. A filter that fails on a message, for
+// example on a field of the wrong type, counts as not matching.
+func filtered(params *models.ConsumerParams, metadata *models.MessageMetadata, queue_data string) bool {
+	const FUNCNAME = "filtered"
+
+	matched, err := utils.FilterMatches(params.Filter, metadata, queue_data)
+	if err != nil {
+		logger.E(FUNCNAME, fmt.Sprintf("filter failed. id:%s, queue_name:%s, error:%s", params.Id, params.QueueName, err.Error()))
+	}
+	if matched {
+		return false
+	}
+
+	logger.I(FUNCNAME, fmt.Sprintf("message filtered out and acked. id:%s, queue_name:%s, routing_key:%s", params.Id, params.QueueName, metadata.RoutingKey))
+	utils.CountFiltered(params.Id)
+	return true
+}
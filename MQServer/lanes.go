@@ -0,0 +1,163 @@
+package MQServer
+
+import (
+	"context"
+	"go-rabbitmq-consumers/models"
+	"go-rabbitmq-consumers/utils"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// PARTITION_PREFETCH_PER_LANE is the prefetch a partitioned consumer asks for
+// per lane, so a lane blocked on retries does not use up the prefetch of the
+// others right away.
+const PARTITION_PREFETCH_PER_LANE = 10
+
+// receiveLanes spreads messages over the consumer's partition lanes by their
+// partition key. Each lane delivers its messages one at a time, in the order
+// they arrived. Once ctx is cancelled every lane finishes the message it holds
+// and gives its backlog back to the queue.
+func (mq *RabbitMQServer) receiveLanes(ctx context.Context, pause context.CancelFunc, ch *amqp.Channel, params *models.ConsumerParams, msg <-chan amqp.Delivery) {
+	lanes := utils.SetConsumerLanes(params.Id, params.Partition.Lanes)
+
+	// Each lane holds its share of the prefetch, so a lane blocked on retries
+	// cannot take all of it. Dispatching waits while the lane of the next
+	// message is full, which keeps the order of its key.
+	size := prefetchCount(params) / len(lanes)
+	if size < 1 {
+		size = 1
+	}
+	queues := make([]chan laneDelivery, len(lanes))
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan laneDelivery, size)
+		wg.Add(1)
+		go func(lane *utils.Lane, queue <-chan laneDelivery) {
+			defer wg.Done()
+			for d := range queue {
+				if ctx.Err() != nil || mq.closed() {
+					d.data.Nack(false, true)
+					lane.Done(false)
+					continue
+				}
+				mq.deliverOnLane(ch, params, d.data, d.body, lane)
+				lane.Done(true)
+				if utils.CallbackBreaker(params).IsOpen() {
+					pause()
+				}
+			}
+		}(lanes[i], queues[i])
+	}
+
+dispatch:
+	for {
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case data, ok := <-msg:
+			if !ok || mq.closed() {
+				break dispatch
+			}
+			i, body := laneOf(params, data)
+			lanes[i].Queued()
+			select {
+			case queues[i] <- laneDelivery{data: data, body: body}:
+			case <-ctx.Done():
+				data.Nack(false, true)
+				lanes[i].Done(false)
+				break dispatch
+			}
+		}
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+}
+
+// laneDelivery is a message waiting on a lane, with its body when picking
+// the lane already transformed it.
+type laneDelivery struct {
+	data amqp.Delivery
+	body *transformedBody
+}
+
+// prefetchCount is how many unacked messages the broker may hand the
+// consumer. A batch can only fill up, and every worker or lane only stays
+// busy, when the broker may hand out that many.
+func prefetchCount(params *models.ConsumerParams) int {
+	prefetch := params.Qos
+	if prefetch == 0 {
+		prefetch = 1
+	}
+	switch {
+	case utils.PartitionEnabled(params.Partition):
+		if lanes := params.Partition.Lanes * PARTITION_PREFETCH_PER_LANE; lanes > prefetch {
+			prefetch = lanes
+		}
+	case utils.BatchEnabled(params.Batch) && params.Batch.Size > prefetch:
+		prefetch = params.Batch.Size
+	case params.Concurrency > prefetch:
+		prefetch = params.Concurrency
+	}
+	return prefetch
+}
+
+// laneOf picks the lane of a message by its partition key. A key read from
+// the body needs the transformed body, which is returned so the lane does not
+// transform it again.
+func laneOf(params *models.ConsumerParams, data amqp.Delivery) (int, *transformedBody) {
+	metadata := messageMetadata(data)
+	if params.Partition.JSONPath == "" {
+		return utils.PartitionLane(params.Partition, metadata, "", data.DeliveryTag), nil
+	}
+	// A message that fails to transform is parked by its lane.
+	body := &transformedBody{}
+	body.queue_data, body.err = transformBody(params, data, metadata)
+	return utils.PartitionLane(params.Partition, metadata, body.queue_data, data.DeliveryTag), body
+}
+
+// retryOnLane retries the failed targets of a message in place by the
+// consumer's retry policy, so the messages behind it on the lane keep their
+// order. The lane shows as blocked meanwhile. It returns false when the
+// consumer stopped before the message could be settled.
+func (mq *RabbitMQServer) retryOnLane(params *models.ConsumerParams, lane *utils.Lane, targets []models.CallbackTarget, queue_data string, metadata *models.MessageMetadata, outcomes []outcome) bool {
+	defer lane.Retrying(0)
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		results := make([]utils.RuleResult, len(outcomes))
+		for i, o := range outcomes {
+			results[i] = o.result
+		}
+		if utils.AckResult(params.AckPolicy, results).Success || permanent(outcomes) {
+			return true
+		}
+		delay, ok := utils.RetryDelay(params.RetryPolicy, attempt, time.Since(start))
+		if !ok {
+			return true
+		}
+
+		lane.Retrying(attempt)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-mq.StopCtx.Done():
+			timer.Stop()
+			return false
+		}
+
+		for i, target := range targets {
+			if outcomes[i].result.Success {
+				continue
+			}
+			if utils.WaitRateLimit(mq.StopCtx, params.Id, target.URL) != nil {
+				return false
+			}
+			outcomes[i] = send(params, target, queue_data, metadata)
+		}
+	}
+}
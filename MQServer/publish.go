@@ -0,0 +1,49 @@
+package MQServer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// PUBLISH_CONFIRM_TIMEOUT bounds the wait for the broker to confirm a message
+// we moved out of a consumer queue.
+const PUBLISH_CONFIRM_TIMEOUT = 10 * time.Second
+
+// publishConfirmed publishes msg as mandatory on ch, which must not be used
+// for anything else, and waits for the broker to take it. A message the
+// broker returns because no queue took it counts as not published.
+func publishConfirmed(ch *amqp.Channel, exchange, key string, msg amqp.Publishing) error {
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	// The broker returns the message before it confirms it when the queue is
+	// gone.
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+	if err := ch.Publish(exchange, key, true, false, msg); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(PUBLISH_CONFIRM_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case confirm, ok := <-confirms:
+		if !ok {
+			return fmt.Errorf("channel closed before the publish was confirmed")
+		}
+		if !confirm.Ack {
+			return fmt.Errorf("broker rejected the message")
+		}
+		select {
+		case r := <-returns:
+			return fmt.Errorf("queue %s did not take the message: %s", key, r.ReplyText)
+		default:
+			return nil
+		}
+	case <-timer.C:
+		return fmt.Errorf("no publish confirmation after %s", PUBLISH_CONFIRM_TIMEOUT)
+	}
+}
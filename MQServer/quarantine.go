@@ -0,0 +1,154 @@
+package MQServer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"go-rabbitmq-consumers/db"
+	"go-rabbitmq-consumers/logger"
+	"go-rabbitmq-consumers/models"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/streadway/amqp"
+)
+
+// HEADER_ORIGINAL_ROUTE carries the exchange and routing key a retry copy or
+// a released quarantined message was first published with.
+const HEADER_ORIGINAL_ROUTE = "x-rch-original-route"
+
+// deliveryAttempts counts how many times a message has been delivered to the
+// consumer, including this time: the deliveries in the attempts store, plus
+// every time it was dead-lettered from the consumer's queue or went through
+// one of its retry queues. Deaths in other consumers' queues do not count.
+func deliveryAttempts(params *models.ConsumerParams, data amqp.Delivery, a *attempt) int {
+	attempts := a.number()
+
+	deaths, _ := data.Headers["x-death"].([]interface{})
+	for _, d := range deaths {
+		death, ok := d.(amqp.Table)
+		if !ok {
+			continue
+		}
+		queue, _ := death["queue"].(string)
+		if queue != params.QueueName && !strings.HasPrefix(queue, params.QueueName+".retry.") {
+			continue
+		}
+		if count, ok := death["count"].(int64); ok {
+			attempts += int(count)
+		}
+	}
+	return attempts
+}
+
+// quarantine takes a message that went over the consumer's attempt limit out
+// of the queue and into the quarantine store, before it reaches a callback
+// again. It returns false when the message is to be delivered as usual.
+func quarantine(params *models.ConsumerParams, data amqp.Delivery, metadata *models.MessageMetadata, a *attempt) bool {
+	const FUNCNAME = "quarantine"
+
+	if params.Quarantine.MaxAttempts <= 0 {
+		return false
+	}
+	attempts := deliveryAttempts(params, data, a)
+	if attempts <= params.Quarantine.MaxAttempts {
+		return false
+	}
+
+	msg := models.QuarantinedMessage{
+		ConsumerId: params.Id,
+		QueueName:  params.QueueName,
+		Body:       string(data.Body),
+		Metadata:   metadata,
+		Attempts:   attempts,
+		Exchange:   metadata.Exchange,
+		RoutingKey: metadata.RoutingKey,
+		ReplyTo:    data.ReplyTo,
+	}
+	if !utf8.Valid(data.Body) {
+		msg.Body, msg.Base64 = base64.StdEncoding.EncodeToString(data.Body), true
+	}
+	if err := db.SaveQuarantined(db.DB, msg); err != nil {
+		logger.E(FUNCNAME, "failed to quarantine message, requeue message.", err.Error())
+		data.Nack(false, true)
+		return true
+	}
+
+	logger.I(FUNCNAME, fmt.Sprintf("message quarantined after %d attempts. id:%s, queue_name:%s, message_id:%s", attempts, params.Id, params.QueueName, data.MessageId))
+	a.done()
+	data.Ack(false)
+	return true
+}
+
+// headersTable turns headers read back from JSON into an AMQP table.
+func headersTable(headers map[string]interface{}) amqp.Table {
+	table := amqp.Table{}
+	for k, v := range headers {
+		table[k] = headerValue(v)
+	}
+	return table
+}
+
+func headerValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return headersTable(v)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = headerValue(item)
+		}
+		return values
+	}
+	return v
+}
+
+// ReleaseQuarantined publishes a quarantined message straight to its queue
+// again, with its body and properties as they were. The x-death history is
+// left behind so the message starts over with a fresh attempt count. The
+// original exchange and routing key travel in HEADER_ORIGINAL_ROUTE, as the
+// message goes through the default exchange.
+func ReleaseQuarantined(config *models.RabbitMQConfig, vhost string, msg models.QuarantinedMessage) error {
+	body := []byte(msg.Body)
+	if msg.Base64 {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(msg.Body); err != nil {
+			return err
+		}
+	}
+
+	publishing := amqp.Publishing{
+		Headers:      amqp.Table{},
+		DeliveryMode: amqp.Persistent,
+		ReplyTo:      msg.ReplyTo,
+		Body:         body,
+	}
+	if metadata := msg.Metadata; metadata != nil {
+		publishing.Headers = headersTable(metadata.Headers)
+		publishing.ContentType = metadata.ContentType
+		publishing.ContentEncoding = metadata.ContentEncoding
+		publishing.MessageId = metadata.MessageId
+		publishing.CorrelationId = metadata.CorrelationId
+		publishing.Timestamp = metadata.Timestamp
+	}
+	delete(publishing.Headers, "x-death")
+	publishing.Headers[HEADER_ORIGINAL_ROUTE] = amqp.Table{
+		"exchange":    msg.Exchange,
+		"routing_key": msg.RoutingKey,
+	}
+
+	conn, err := amqp.DialConfig(fmt.Sprintf("amqp://%s:%s@%s:%d", config.User, config.Password, config.Host, config.Port), amqp.Config{
+		Vhost: vhost,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	return publishConfirmed(ch, "", msg.QueueName, publishing)
+}
@@ -0,0 +1,144 @@
+package MQServer
+
+import (
+	"fmt"
+	"go-rabbitmq-consumers/logger"
+	"go-rabbitmq-consumers/models"
+	"go-rabbitmq-consumers/utils"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// retryQueueName names the delay queue used for a retry delay. Queues are named
+// by delay rather than by attempt so that editing a retry policy never clashes
+// with the x-message-ttl of a queue declared earlier.
+func retryQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%dms", queueName, delay.Milliseconds())
+}
+
+// retryAttempts counts how many times a message already went through the
+// retry queues of queueName, using the x-death header kept by RabbitMQ.
+func retryAttempts(headers amqp.Table, queueName string) int {
+	var attempts int64
+
+	deaths, _ := headers["x-death"].([]interface{})
+	for _, d := range deaths {
+		death, ok := d.(amqp.Table)
+		if !ok {
+			continue
+		}
+		queue, _ := death["queue"].(string)
+		if !strings.HasPrefix(queue, queueName+".retry.") {
+			continue
+		}
+		if count, ok := death["count"].(int64); ok {
+			attempts += count
+		}
+	}
+
+	return int(attempts)
+}
+
+// queueRetryDelay returns the delay before the given attempt and whether the
+// policy still allows it. Queue TTLs are fixed per queue, so jitter is ignored
+// and the elapsed time is the sum of the previous delays.
+func queueRetryDelay(policy models.RetryPolicy, attempt int) (time.Duration, bool) {
+	var elapsed time.Duration
+
+	policy = utils.EffectiveRetryPolicy(policy)
+	policy.Jitter = 0
+
+	for i := 1; i < attempt; i++ {
+		delay, _ := utils.RetryDelay(policy, i, 0)
+		elapsed += delay
+	}
+
+	return utils.RetryDelay(policy, attempt, elapsed)
+}
+
+// retryThroughQueue moves a failed message to the delay queue of its next
+// attempt, or parks its failed callbacks in the failed store once the retry
+// policy is exhausted.
+// The original delivery is only acked after the broker confirmed the copy in
+// the retry queue.
+func (mq *RabbitMQServer) retryThroughQueue(ch *amqp.Channel, params *models.ConsumerParams, data amqp.Delivery, failures []models.FailedCallback, a *attempt) {
+	const FUNCNAME = "retryThroughQueue"
+
+	attempt := retryAttempts(data.Headers, params.QueueName) + 1
+	delay, ok := queueRetryDelay(params.RetryPolicy, attempt)
+	if !ok {
+		if err := saveFailedRequests(failures); err != nil {
+			logger.E(FUNCNAME, "failed to save failed request, requeue message.", err.Error())
+			requeueFailed(params, data, failures[0], a)
+			return
+		}
+		logger.I(FUNCNAME, fmt.Sprintf("retries exhausted, message parked. queue_name:%s, attempts:%d", params.QueueName, attempt-1))
+		a.done()
+		data.Ack(false)
+		return
+	}
+
+	// Expired messages go straight back to the consumer queue through the
+	// default exchange, so other queues bound to the routing key do not see
+	// the retry.
+	retryQueue := retryQueueName(params.QueueName, delay)
+	if err := declareDelayQueue(ch, retryQueue, delay, "", params.QueueName); err != nil {
+		logger.E(FUNCNAME, "failed to declare retry queue", retryQueue, err.Error())
+		requeueFailed(params, data, failures[0], a)
+		return
+	}
+
+	// The copy comes back through the default exchange, so it carries the
+	// route the message was first published with.
+	headers := make(amqp.Table, len(data.Headers)+1)
+	for k, v := range data.Headers {
+		headers[k] = v
+	}
+	headers[HEADER_ORIGINAL_ROUTE] = amqp.Table{
+		"exchange":    failures[0].Metadata.Exchange,
+		"routing_key": failures[0].Metadata.RoutingKey,
+	}
+	err := mq.publishRetry(retryQueue, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     data.ContentType,
+		ContentEncoding: data.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        data.Priority,
+		CorrelationId:   data.CorrelationId,
+		ReplyTo:         data.ReplyTo,
+		MessageId:       data.MessageId,
+		Timestamp:       data.Timestamp,
+		Type:            data.Type,
+		AppId:           data.AppId,
+		Body:            data.Body,
+	})
+	if err != nil {
+		logger.E(FUNCNAME, "failed to publish to retry queue", retryQueue, err.Error())
+		requeueFailed(params, data, failures[0], a)
+		return
+	}
+
+	logger.I(FUNCNAME, fmt.Sprintf("callback failed, retry attempt %d in %s. queue_name:%s, status:%d", attempt, delay, params.QueueName, failures[0].ResponseCode))
+	// The copy in the retry queue is counted by its x-death history, and
+	// claims its dedupe key again when it comes back.
+	releaseDedupe(params, failures[0].Metadata, failures[0].RequestData)
+	a.done()
+	data.Ack(false)
+}
+
+// publishRetry publishes a retry copy on a channel of its own, since confirm
+// mode would otherwise apply to every publish on the consumer channel.
+func (mq *RabbitMQServer) publishRetry(retryQueue string, msg amqp.Publishing) error {
+	if mq.Connnection == nil {
+		return fmt.Errorf("RabbitMQ Connection is nil")
+	}
+	ch, err := mq.Connnection.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	return publishConfirmed(ch, "", retryQueue, msg)
+}
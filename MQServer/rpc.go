@@ -0,0 +1,79 @@
+package MQServer
+
+import (
+	"encoding/json"
+	"go-rabbitmq-consumers/logger"
+	"go-rabbitmq-consumers/models"
+	"go-rabbitmq-consumers/utils"
+
+	"github.com/streadway/amqp"
+)
+
+const DEFAULT_RPC_CONTENT_TYPE = "application/json"
+
+// Values of the x-rch-status header of a reply.
+const (
+	RPC_STATUS_OK    = "ok"
+	RPC_STATUS_ERROR = "error"
+)
+
+// rpcError is the body of an error reply.
+type rpcError struct {
+	Error        string `json:"error"`
+	Rule         string `json:"rule"`
+	ResponseCode int    `json:"response_code"`
+	Response     string `json:"response,omitempty"`
+}
+
+// rpcRequest tells whether a delivery waits for a reply.
+func rpcRequest(params *models.ConsumerParams, data amqp.Delivery) bool {
+	return params.Rpc.Enabled && data.ReplyTo != ""
+}
+
+// reply publishes the final outcome of an RPC message to its ReplyTo queue:
+// the response of the first target that succeeded, or an error reply with the
+// deciding failure.
+func reply(ch *amqp.Channel, params *models.ConsumerParams, data amqp.Delivery, outcomes []outcome, result utils.RuleResult) {
+	if !rpcRequest(params, data) {
+		return
+	}
+
+	if result.Success {
+		for _, o := range outcomes {
+			if o.result.Success {
+				contentType := params.Rpc.ContentType
+				if contentType == "" {
+					contentType = DEFAULT_RPC_CONTENT_TYPE
+				}
+				publishReply(ch, data, RPC_STATUS_OK, contentType, []byte(o.failed.ResponseContent))
+				return
+			}
+		}
+	}
+
+	failed := outcomes[0].failed
+	replyError(ch, data, rpcError{
+		Error:        result.Reason,
+		Rule:         result.Rule,
+		ResponseCode: failed.ResponseCode,
+		Response:     failed.ResponseContent,
+	})
+}
+
+// replyError publishes an error reply.
+func replyError(ch *amqp.Channel, data amqp.Delivery, reply rpcError) {
+	body, _ := json.Marshal(reply)
+	publishReply(ch, data, RPC_STATUS_ERROR, DEFAULT_RPC_CONTENT_TYPE, body)
+}
+
+func publishReply(ch *amqp.Channel, data amqp.Delivery, status, contentType string, body []byte) {
+	err := ch.Publish("", data.ReplyTo, false, false, amqp.Publishing{
+		Headers:       amqp.Table{"x-rch-status": status},
+		ContentType:   contentType,
+		CorrelationId: data.CorrelationId,
+		Body:          body,
+	})
+	if err != nil {
+		logger.E("publishReply", "failed to publish reply to", data.ReplyTo, err.Error())
+	}
+}
@@ -0,0 +1,56 @@
+package MQServer
+
+import (
+	"context"
+	"go-rabbitmq-consumers/models"
+	"go-rabbitmq-consumers/utils"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// receive delivers messages on params.Concurrency workers, or on a single one
+// when it is not set. Each worker settles its own deliveries, so acks stay
+// per message. Once ctx is cancelled the workers finish the message they hold
+// and receive returns after the last one. A worker that finds the callback
+// breaker open calls pause to stop the others.
+func (mq *RabbitMQServer) receive(ctx context.Context, pause context.CancelFunc, ch *amqp.Channel, params *models.ConsumerParams, msg <-chan amqp.Delivery) {
+	if utils.PartitionEnabled(params.Partition) {
+		mq.receiveLanes(ctx, pause, ch, params, msg)
+		return
+	}
+
+	workers := params.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				select {
+				case <-ctx.Done():
+					return
+				case data, ok := <-msg:
+					if !ok || mq.closed() {
+						return
+					}
+
+					mq.deliver(ch, params, data)
+					if utils.CallbackBreaker(params).IsOpen() {
+						pause()
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// closed reports whether the broker connection has gone away.
+func (mq *RabbitMQServer) closed() bool {
+	return mq.Connnection != nil && mq.Connnection.IsClosed()
+}
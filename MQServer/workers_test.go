@@ -0,0 +1,710 @@
+package MQServer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-rabbitmq-consumers/db"
+	"go-rabbitmq-consumers/models"
+	"go-rabbitmq-consumers/utils"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeAcknowledger records how every delivery was settled.
+type fakeAcknowledger struct {
+	mu       sync.Mutex
+	acked    map[uint64]int
+	rejected int
+}
+
+func newFakeAcknowledger() *fakeAcknowledger {
+	return &fakeAcknowledger{acked: map[uint64]int{}}
+}
+
+func (f *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.acked[tag]++
+	return nil
+}
+
+func (f *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rejected++
+	return nil
+}
+
+func (f *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return f.Nack(tag, false, requeue)
+}
+
+func (f *fakeAcknowledger) ackedOnce(n int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rejected > 0 {
+		return fmt.Errorf("%d deliveries rejected", f.rejected)
+	}
+	for tag := uint64(1); tag <= uint64(n); tag++ {
+		if f.acked[tag] != 1 {
+			return fmt.Errorf("delivery %d acked %d times", tag, f.acked[tag])
+		}
+	}
+	return nil
+}
+
+// fakeCallback is a callback server that answers every request successfully
+// after delay and tracks the number of requests in flight.
+type fakeCallback struct {
+	*httptest.Server
+	requests    int32
+	inflight    int32
+	maxInflight int32
+	failing     int32
+}
+
+func newFakeCallback(delay time.Duration) *fakeCallback {
+	f := &fakeCallback{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.requests, 1)
+		if atomic.LoadInt32(&f.failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		n := atomic.AddInt32(&f.inflight, 1)
+		defer atomic.AddInt32(&f.inflight, -1)
+		for {
+			max := atomic.LoadInt32(&f.maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&f.maxInflight, max, n) {
+				break
+			}
+		}
+		time.Sleep(delay)
+		w.Write([]byte(`{"error_code":0}`))
+	}))
+	return f
+}
+
+func newTestServer() *RabbitMQServer {
+	mq := &RabbitMQServer{}
+	mq.StopCtx, mq.Stop = context.WithCancel(context.Background())
+	return mq
+}
+
+func testDeliveries(ack amqp.Acknowledger, n int) chan amqp.Delivery {
+	msg := make(chan amqp.Delivery, n)
+	for i := 1; i <= n; i++ {
+		msg <- amqp.Delivery{Acknowledger: ack, DeliveryTag: uint64(i), Body: []byte(fmt.Sprintf(`{"id":%d}`, i))}
+	}
+	return msg
+}
+
+func receiveAll(t *testing.T, callback string, concurrency, n int) (time.Duration, *fakeAcknowledger) {
+	ack := newFakeAcknowledger()
+	msg := testDeliveries(ack, n)
+	close(msg)
+
+	params := &models.ConsumerParams{Id: "1", QueueName: "test", Callback: callback, Concurrency: concurrency}
+	mq := newTestServer()
+	start := time.Now()
+	mq.receive(mq.StopCtx, mq.Stop, nil, params, msg)
+	elapsed := time.Since(start)
+
+	if err := ack.ackedOnce(n); err != nil {
+		t.Fatalf("concurrency %d: %s", concurrency, err)
+	}
+	return elapsed, ack
+}
+
+func TestReceiveThroughput(t *testing.T) {
+	const messages = 50
+	callback := newFakeCallback(10 * time.Millisecond)
+	defer callback.Close()
+
+	sequential, _ := receiveAll(t, callback.URL, 0, messages)
+	if max := atomic.LoadInt32(&callback.maxInflight); max != 1 {
+		t.Fatalf("sequential consumer had %d callbacks in flight", max)
+	}
+
+	atomic.StoreInt32(&callback.maxInflight, 0)
+	concurrent, _ := receiveAll(t, callback.URL, 10, messages)
+	if max := atomic.LoadInt32(&callback.maxInflight); max > 10 {
+		t.Fatalf("concurrency 10 had %d callbacks in flight", max)
+	}
+
+	t.Logf("%d messages: sequential %s, concurrency 10 %s", messages, sequential, concurrent)
+	if concurrent*3 > sequential {
+		t.Fatalf("concurrency 10 took %s, sequential %s", concurrent, sequential)
+	}
+}
+
+func TestReceiveStopSettlesInflight(t *testing.T) {
+	const workers = 5
+	callback := newFakeCallback(100 * time.Millisecond)
+	defer callback.Close()
+
+	ack := newFakeAcknowledger()
+	msg := testDeliveries(ack, workers)
+	params := &models.ConsumerParams{Id: "1", QueueName: "test", Callback: callback.URL, Concurrency: workers}
+	mq := newTestServer()
+
+	done := make(chan struct{})
+	go func() {
+		mq.receive(mq.StopCtx, mq.Stop, nil, params, msg)
+		close(done)
+	}()
+
+	for atomic.LoadInt32(&callback.inflight) < workers {
+		time.Sleep(time.Millisecond)
+	}
+	mq.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("receive did not return after stop")
+	}
+	if err := ack.ackedOnce(workers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceivePausesOnOpenBreaker(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	callback := newFakeCallback(0)
+	defer callback.Close()
+	atomic.StoreInt32(&callback.failing, 1)
+
+	params := &models.ConsumerParams{
+		Id:             "1",
+		QueueName:      "test",
+		Callback:       callback.URL,
+		DeliveryMode:   models.DELIVERY_AT_LEAST_ONCE,
+		RetryPolicy:    models.RetryPolicy{InitialDelay: "1ms"},
+		CircuitBreaker: models.CircuitBreaker{FailureThreshold: 3, OpenTimeout: "50ms"},
+	}
+	utils.SetCallbackBreaker(params.Callback, params.CircuitBreaker)
+	breaker := utils.CallbackBreaker(params)
+
+	ack := newFakeAcknowledger()
+	msg := testDeliveries(ack, 10)
+	mq := newTestServer()
+	ctx, pause := context.WithCancel(mq.StopCtx)
+	mq.receive(ctx, pause, nil, params, msg)
+
+	if ctx.Err() == nil {
+		t.Fatal("receive returned without pausing")
+	}
+	if n := atomic.LoadInt32(&callback.requests); n != 3 {
+		t.Fatalf("%d callbacks sent, want 3", n)
+	}
+	if state := breaker.State().State; state != utils.BREAKER_OPEN {
+		t.Fatalf("breaker is %s", state)
+	}
+	// Only the deliveries that reached the callback count as attempts.
+	var counted int
+	database.QueryRow("SELECT COUNT(*) FROM delivery_attempts").Scan(&counted)
+	if counted != 3 {
+		t.Fatalf("%d messages with counted attempts, want 3", counted)
+	}
+
+	atomic.StoreInt32(&callback.failing, 0)
+	if !breaker.WaitHalfOpen(mq.StopCtx) {
+		t.Fatal("breaker did not become half-open")
+	}
+	ctx, pause = context.WithCancel(mq.StopCtx)
+	close(msg)
+	mq.receive(ctx, pause, nil, params, msg)
+
+	if state := breaker.State().State; state != utils.BREAKER_CLOSED {
+		t.Fatalf("breaker is %s after successful probes", state)
+	}
+	if n := atomic.LoadInt32(&callback.requests); n != 10 {
+		t.Fatalf("%d callbacks sent, want 10", n)
+	}
+}
+
+func TestDeliverFanOutAckPolicy(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	primary := newFakeCallback(0)
+	defer primary.Close()
+	secondary := newFakeCallback(0)
+	defer secondary.Close()
+	atomic.StoreInt32(&secondary.failing, 1)
+
+	params := &models.ConsumerParams{
+		Id:              "1",
+		QueueName:       "test",
+		Callback:        primary.URL,
+		CallbackTargets: []models.CallbackTarget{{URL: secondary.URL}},
+		DeliveryMode:    models.DELIVERY_AT_LEAST_ONCE,
+		RetryPolicy:     models.RetryPolicy{InitialDelay: "1ms"},
+	}
+
+	// Every target must succeed: the message goes back to the queue.
+	params.AckPolicy = models.ACK_POLICY_ALL
+	ack := newFakeAcknowledger()
+	newTestServer().deliver(nil, params, amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Body: []byte(`{}`)})
+	if ack.rejected != 1 || len(ack.acked) != 0 {
+		t.Fatalf("policy all: acked %v, rejected %d", ack.acked, ack.rejected)
+	}
+
+	// The primary is enough: the message is acked and only the failed target
+	// is queued for a retry.
+	params.AckPolicy = models.ACK_POLICY_PRIMARY
+	ack = newFakeAcknowledger()
+	newTestServer().deliver(nil, params, amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Body: []byte(`{}`)})
+	if err := ack.ackedOnce(1); err != nil {
+		t.Fatalf("policy primary: %s", err)
+	}
+
+	jobs, err := db.FetchRetryJobs(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].RequestURL != secondary.URL {
+		t.Fatalf("retry jobs %+v, want one for %s", jobs, secondary.URL)
+	}
+}
+
+func TestDeliverSchedulesLongRetry(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	callback := newFakeCallback(0)
+	defer callback.Close()
+	atomic.StoreInt32(&callback.failing, 1)
+
+	params := &models.ConsumerParams{
+		Id:           "1",
+		QueueName:    "test",
+		Callback:     callback.URL,
+		DeliveryMode: models.DELIVERY_AT_LEAST_ONCE,
+		RetryPolicy:  models.RetryPolicy{InitialDelay: "1m"},
+	}
+
+	// A delay longer than the hold limit is not waited out by the worker: the
+	// message is acked and the scheduler retries the callback.
+	ack := newFakeAcknowledger()
+	start := time.Now()
+	newTestServer().deliver(nil, params, amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Body: []byte(`{}`)})
+	if time.Since(start) > RETRY_HOLD_LIMIT {
+		t.Fatalf("worker held the message for %s", time.Since(start))
+	}
+	if err := ack.ackedOnce(1); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := db.FetchRetryJobs(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Attempt != 0 || time.Until(time.UnixMilli(jobs[0].NextRunAt)) < 55*time.Second {
+		t.Fatalf("retry jobs %+v, want one in a minute", jobs)
+	}
+}
+
+func TestDeliverBatchHoldsOnce(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	callback := newFakeCallback(0)
+	defer callback.Close()
+	atomic.StoreInt32(&callback.failing, 1)
+
+	params := &models.ConsumerParams{
+		Id:           "1",
+		QueueName:    "test",
+		Callback:     callback.URL,
+		DeliveryMode: models.DELIVERY_AT_LEAST_ONCE,
+		RetryPolicy:  models.RetryPolicy{InitialDelay: "200ms"},
+		Batch:        models.BatchSettings{Size: 5},
+	}
+
+	// The failed items go back to the queue after one delay, not one each.
+	ack := newFakeAcknowledger()
+	batch := make([]amqp.Delivery, 5)
+	for i := range batch {
+		batch[i] = amqp.Delivery{Acknowledger: ack, DeliveryTag: uint64(i + 1), Body: []byte(fmt.Sprintf(`{"id":%d}`, i+1))}
+	}
+	start := time.Now()
+	newTestServer().deliverBatch(nil, params, batch)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 600*time.Millisecond {
+		t.Fatalf("batch held for %s, want 200ms", elapsed)
+	}
+	if ack.rejected != 5 || len(ack.acked) != 0 {
+		t.Fatalf("batch settled as %+v", ack)
+	}
+}
+
+func TestDeliverRetryCopyKeepsRoute(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	orders := newFakeCallback(0)
+	defer orders.Close()
+
+	params := &models.ConsumerParams{
+		Id:           "1",
+		QueueName:    "test",
+		Callback:     "http://127.0.0.1:1",
+		RoutingRules: []models.RoutingRule{{RoutingKey: "order.*", Callback: orders.URL}},
+		DropUnrouted: true,
+	}
+
+	// A copy back from a retry queue is routed by its original routing key,
+	// not by the queue name it was dead-lettered with.
+	ack := newFakeAcknowledger()
+	newTestServer().deliver(nil, params, amqp.Delivery{
+		Acknowledger: ack,
+		DeliveryTag:  1,
+		RoutingKey:   "test",
+		Headers:      amqp.Table{HEADER_ORIGINAL_ROUTE: amqp.Table{"exchange": "orders", "routing_key": "order.paid"}},
+		Body:         []byte(`{}`),
+	})
+	if err := ack.ackedOnce(1); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&orders.requests); n != 1 {
+		t.Fatalf("%d callbacks sent to the routed target, want 1", n)
+	}
+}
+
+func TestDeliverDedupe(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	callback := newFakeCallback(0)
+	defer callback.Close()
+
+	params := &models.ConsumerParams{
+		Id:           "1",
+		QueueName:    "test",
+		Callback:     callback.URL,
+		DeliveryMode: models.DELIVERY_AT_LEAST_ONCE,
+		RetryPolicy:  models.RetryPolicy{InitialDelay: "1ms"},
+		Dedupe:       models.Dedupe{Source: models.DEDUPE_MESSAGE_ID},
+	}
+	mq := newTestServer()
+	ack := newFakeAcknowledger()
+	// A copy of a delivered message is a duplicate, redelivered or not.
+	for tag, redelivered := range []bool{false, false, true} {
+		mq.deliver(nil, params, amqp.Delivery{Acknowledger: ack, DeliveryTag: uint64(tag + 1), MessageId: "m-1", Redelivered: redelivered, Body: []byte(`{}`)})
+	}
+	if err := ack.ackedOnce(3); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&callback.requests); n != 1 {
+		t.Fatalf("%d callbacks sent, want 1", n)
+	}
+
+	// A message that failed its callback comes back as a retry, not a
+	// duplicate.
+	atomic.StoreInt32(&callback.failing, 1)
+	mq.deliver(nil, params, amqp.Delivery{Acknowledger: ack, DeliveryTag: 4, MessageId: "m-2", Body: []byte(`{}`)})
+	atomic.StoreInt32(&callback.failing, 0)
+	mq.deliver(nil, params, amqp.Delivery{Acknowledger: ack, DeliveryTag: 5, MessageId: "m-2", Redelivered: true, Body: []byte(`{}`)})
+	if ack.rejected != 1 || ack.acked[5] != 1 {
+		t.Fatalf("retry settled as %+v", ack)
+	}
+	if n := atomic.LoadInt32(&callback.requests); n != 3 {
+		t.Fatalf("%d callbacks sent, want 3", n)
+	}
+
+	// Of two redelivered copies of a failed message, only the first is a
+	// retry.
+	atomic.StoreInt32(&callback.failing, 1)
+	mq.deliver(nil, params, amqp.Delivery{Acknowledger: ack, DeliveryTag: 6, MessageId: "m-3", Body: []byte(`{}`)})
+	atomic.StoreInt32(&callback.failing, 0)
+	for tag := uint64(7); tag <= 8; tag++ {
+		mq.deliver(nil, params, amqp.Delivery{Acknowledger: ack, DeliveryTag: tag, MessageId: "m-3", Redelivered: true, Body: []byte(`{}`)})
+	}
+	if ack.rejected != 2 || ack.acked[7] != 1 || ack.acked[8] != 1 {
+		t.Fatalf("copies settled as %+v", ack)
+	}
+	if n := atomic.LoadInt32(&callback.requests); n != 5 {
+		t.Fatalf("%d callbacks sent, want 5", n)
+	}
+
+	stats, err := db.FetchDedupeStats(database, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Hits != 3 || stats[0].ActiveKeys != 3 {
+		t.Fatalf("dedupe stats %+v", stats)
+	}
+	if n, _ := db.DeleteExpiredDedupeKeys(database, time.Now().Add(utils.DEFAULT_DEDUPE_WINDOW)); n != 3 {
+		t.Fatalf("%d expired keys deleted, want 3", n)
+	}
+}
+
+func TestReceiveLanesKeepOrderPerKey(t *testing.T) {
+	partition := models.Partition{Lanes: 2, JSONPath: "key"}
+	laneOfKey := func(key string) int {
+		return utils.PartitionLane(partition, &models.MessageMetadata{}, fmt.Sprintf(`{"key":%q}`, key), 0)
+	}
+	// Find a key on the other lane than "a".
+	other := "b"
+	for i := 0; laneOfKey(other) == laneOfKey("a"); i++ {
+		other = fmt.Sprintf("b%d", i)
+	}
+
+	var (
+		mu       sync.Mutex
+		attempts = map[string]int{}
+		order    []string
+		blocked  models.LaneState
+	)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Key string `json:"key"`
+			Seq int    `json:"seq"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		message := fmt.Sprintf("%s%d", body.Key, body.Seq)
+
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[message]++
+		// The first message of "a" fails twice, blocking its lane meanwhile.
+		if message == "a1" && attempts[message] <= 2 {
+			if attempts[message] == 2 {
+				blocked = utils.LaneStates()["1"][laneOfKey("a")]
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		order = append(order, message)
+		w.Write([]byte(`{"error_code":0}`))
+	}))
+	defer callback.Close()
+
+	ack := newFakeAcknowledger()
+	msg := make(chan amqp.Delivery, 6)
+	for i, body := range []string{"a:1", "o:1", "a:2", "o:2", "a:3", "o:3"} {
+		key, seq := body[:1], body[2:]
+		if key == "o" {
+			key = other
+		}
+		msg <- amqp.Delivery{Acknowledger: ack, DeliveryTag: uint64(i + 1), Body: []byte(fmt.Sprintf(`{"key":%q,"seq":%s}`, key, seq))}
+	}
+	close(msg)
+
+	params := &models.ConsumerParams{
+		Id:          "1",
+		QueueName:   "test",
+		Callback:    callback.URL,
+		Partition:   partition,
+		RetryPolicy: models.RetryPolicy{MaxAttempts: 3, InitialDelay: "50ms"},
+	}
+	utils.SetConsumerLanes(params.Id, partition.Lanes)
+	defer utils.RemoveConsumerLanes(params.Id)
+
+	mq := newTestServer()
+	mq.receive(mq.StopCtx, mq.Stop, nil, params, msg)
+
+	if err := ack.ackedOnce(6); err != nil {
+		t.Fatal(err)
+	}
+	if !blocked.Blocked || blocked.Attempt != 1 {
+		t.Fatalf("lane of the failing key %+v, want blocked on attempt 1", blocked)
+	}
+
+	// Each key keeps its order, and the other lane went on while "a" retried.
+	var keyA, keyOther []string
+	for _, message := range order {
+		if message[:1] == "a" {
+			keyA = append(keyA, message)
+		} else {
+			keyOther = append(keyOther, message)
+		}
+	}
+	if fmt.Sprint(keyA) != "[a1 a2 a3]" || fmt.Sprint(keyOther) != fmt.Sprintf("[%[1]s1 %[1]s2 %[1]s3]", other) {
+		t.Fatalf("delivery order %v", order)
+	}
+	if order[0] == "a1" {
+		t.Fatalf("other lane waited for the failing key: %v", order)
+	}
+
+	states := utils.LaneStates()["1"]
+	if states[laneOfKey("a")].Delivered != 3 || states[laneOfKey("a")].Backlog != 0 || states[laneOfKey("a")].Blocked {
+		t.Fatalf("lane states %+v", states)
+	}
+}
+
+func TestReceiveLanesHoldTheirShare(t *testing.T) {
+	release := make(chan struct{})
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"error_code":0}`))
+	}))
+	defer callback.Close()
+
+	ack := newFakeAcknowledger()
+	msg := make(chan amqp.Delivery, 40)
+	for i := 1; i <= 40; i++ {
+		msg <- amqp.Delivery{Acknowledger: ack, DeliveryTag: uint64(i), Body: []byte(`{"key":"a"}`)}
+	}
+	close(msg)
+
+	params := &models.ConsumerParams{
+		Id:        "1",
+		QueueName: "test",
+		Callback:  callback.URL,
+		Partition: models.Partition{Lanes: 2, JSONPath: "key"},
+	}
+	defer utils.RemoveConsumerLanes(params.Id)
+
+	mq := newTestServer()
+	done := make(chan struct{})
+	go func() {
+		mq.receive(mq.StopCtx, mq.Stop, nil, params, msg)
+		close(done)
+	}()
+
+	// A busy lane holds its half of the prefetch, the message in delivery and
+	// the one waiting to be dispatched.
+	time.Sleep(100 * time.Millisecond)
+	var backlog int
+	for _, state := range utils.LaneStates()["1"] {
+		backlog += state.Backlog
+	}
+	close(release)
+	<-done
+	if limit := prefetchCount(params)/2 + 2; backlog > limit {
+		t.Fatalf("lane backlog %d, want at most %d", backlog, limit)
+	}
+	if err := ack.ackedOnce(40); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeliverQuarantine(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	callback := newFakeCallback(0)
+	defer callback.Close()
+
+	params := &models.ConsumerParams{
+		Id:         "1",
+		QueueName:  "test",
+		Callback:   callback.URL,
+		Quarantine: models.Quarantine{MaxAttempts: 2},
+	}
+	mq := newTestServer()
+	ack := newFakeAcknowledger()
+	// The Redelivered flag alone does not count: m-1 is settled each time.
+	mq.deliver(nil, params, amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, MessageId: "m-1", Body: []byte(`{}`)})
+	mq.deliver(nil, params, amqp.Delivery{Acknowledger: ack, DeliveryTag: 2, MessageId: "m-1", Redelivered: true, Body: []byte(`{}`)})
+	// Dead-letter rounds through other consumers' queues do not count.
+	mq.deliver(nil, params, amqp.Delivery{
+		Acknowledger: ack,
+		DeliveryTag:  3,
+		MessageId:    "m-2",
+		Headers:      amqp.Table{"x-death": []interface{}{amqp.Table{"queue": "other", "reason": "rejected", "count": int64(5)}}},
+		Body:         []byte(`{}`),
+	})
+	// m-3 was delivered once before without being settled and went through
+	// the consumer's retry queue once, so this is its third attempt.
+	if _, _, err := db.AddDeliveryAttempt(database, "1", "id:m-3", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	mq.deliver(nil, params, amqp.Delivery{
+		Acknowledger: ack,
+		DeliveryTag:  4,
+		Exchange:     "orders",
+		RoutingKey:   "order.paid",
+		ReplyTo:      "replies",
+		MessageId:    "m-3",
+		Redelivered:  true,
+		Headers:      amqp.Table{"x-death": []interface{}{amqp.Table{"queue": "test.retry.5000ms", "reason": "expired", "count": int64(1)}}, "x-tenant": "acme"},
+		Body:         []byte{0xff, 0x00},
+	})
+	// A new message sharing the body of a failing one starts its own count.
+	fresh := amqp.Delivery{Acknowledger: ack, DeliveryTag: 5, RoutingKey: "test", Body: []byte(`{"id":1}`)}
+	if err := db.KeepDeliveryAttempts(database, "1", messageKey(fresh), 5, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	mq.deliver(nil, params, fresh)
+
+	if err := ack.ackedOnce(5); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&callback.requests); n != 4 {
+		t.Fatalf("%d callbacks sent, want 4", n)
+	}
+	if n, _ := db.FetchDeliveryAttempts(database, "1", "id:m-3"); n != 0 {
+		t.Fatalf("%d attempts kept for a quarantined message", n)
+	}
+
+	messages, err := db.FetchQuarantinedMessages(database, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("%d messages quarantined, want 1", len(messages))
+	}
+	msg := messages[0]
+	if msg.Attempts != 3 || !msg.Base64 || msg.Body != "/wA=" || msg.Metadata.MessageId != "m-3" || msg.Metadata.Headers["x-tenant"] != "acme" {
+		t.Fatalf("quarantined %+v", msg)
+	}
+	if msg.Exchange != "orders" || msg.RoutingKey != "order.paid" || msg.ReplyTo != "replies" {
+		t.Fatalf("quarantined without its route: %+v", msg)
+	}
+
+	// Released through the default exchange, the message still reports its
+	// original route.
+	metadata := messageMetadata(amqp.Delivery{
+		RoutingKey: "test",
+		Headers: amqp.Table{
+			HEADER_ORIGINAL_ROUTE: amqp.Table{"exchange": msg.Exchange, "routing_key": msg.RoutingKey},
+			"x-tenant":            "acme",
+		},
+	})
+	if metadata.Exchange != "orders" || metadata.RoutingKey != "order.paid" || len(metadata.Headers) != 1 {
+		t.Fatalf("released message metadata %+v", metadata)
+	}
+
+	// Headers read back from the store publish as a valid AMQP table.
+	headers := headersTable(msg.Metadata.Headers)
+	if _, ok := headers["x-death"].([]interface{})[0].(amqp.Table); !ok {
+		t.Fatalf("x-death read back as %T", headers["x-death"])
+	}
+	if err := headers.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,13 +1,18 @@
 package api
 
 import (
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"go-rabbitmq-consumers/MQServer"
+	"go-rabbitmq-consumers/db"
 	"go-rabbitmq-consumers/logger"
 	"go-rabbitmq-consumers/models"
+	"go-rabbitmq-consumers/scheduler"
 	"go-rabbitmq-consumers/utils"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -52,20 +57,12 @@ func FetchRabbitMQConfig(database *sql.DB) (*models.RabbitMQConfig, error) {
 func AddConsumer(database *sql.DB, consumer *models.ConsumerParams) (int64, error) {
 	const FUNCNAME = "AddConsumer"
 
-	result, err := database.Exec(`INSERT INTO consumers (name, status, queue_name, exchange_name, routing_key, death_queue_name, death_queue_bind_exchange, death_queue_bind_routing_key, death_queue_ttl, callback, retry_mode, queue_count, vhost) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		consumer.Name, consumer.Status, consumer.QueueName, consumer.ExchangeName, consumer.RoutingKey, consumer.DeathQueue.QueueName, consumer.DeathQueue.BindExchange, consumer.DeathQueue.BindRoutingKey, consumer.DeathQueue.TTL, consumer.Callback, consumer.RetryMode, consumer.QueueCount, consumer.VHost)
+	id, err := db.InsertConsumer(database, consumer)
 	if err != nil {
 		logger.E(FUNCNAME, "failed to add consumer.", err.Error())
 		return 0, err
 	}
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		logger.E(FUNCNAME, "failed to get last insert ID.", err.Error())
-		return 0, err
-	}
-
 	return id, nil
 }
 
@@ -73,10 +70,7 @@ func AddConsumer(database *sql.DB, consumer *models.ConsumerParams) (int64, erro
 func EditConsumer(database *sql.DB, consumer *models.ConsumerParams) error {
 	const FUNCNAME = "EditConsumer"
 
-	_, err := database.Exec(`UPDATE consumers SET name = ?, status = ?, queue_name = ?, exchange_name = ?, routing_key = ?, death_queue_name = ?, death_queue_bind_exchange = ?, death_queue_bind_routing_key = ?, death_queue_ttl = ?, callback = ?, retry_mode = ?, queue_count = ?, vhost = ? 
-		WHERE id = ?`,
-		consumer.Name, consumer.Status, consumer.QueueName, consumer.ExchangeName, consumer.RoutingKey, consumer.DeathQueue.QueueName, consumer.DeathQueue.BindExchange, consumer.DeathQueue.BindRoutingKey, consumer.DeathQueue.TTL, consumer.Callback, consumer.RetryMode, consumer.QueueCount, consumer.VHost, consumer.Id)
-	if err != nil {
+	if err := db.UpdateConsumer(database, consumer); err != nil {
 		logger.E(FUNCNAME, "failed to edit consumer.", err.Error())
 		return err
 	}
@@ -84,15 +78,163 @@ func EditConsumer(database *sql.DB, consumer *models.ConsumerParams) error {
 	return nil
 }
 
+// MAX_CONCURRENCY bounds the number of deliveries a consumer handles at once.
+const MAX_CONCURRENCY = 256
+
+// validateConsumer rejects consumer settings that the runtime could not apply
+func validateConsumer(consumer *models.ConsumerParams) error {
+	if err := utils.ValidateRetryPolicy(consumer.RetryPolicy); err != nil {
+		return fmt.Errorf("invalid retry_policy: %s", err.Error())
+	}
+	if err := utils.ValidateSuccessCriteria(consumer.SuccessCriteria); err != nil {
+		return fmt.Errorf("invalid success_criteria: %s", err.Error())
+	}
+	if method, err := utils.ParseHttpMethod(consumer.CallbackMethod); err != nil || method == utils.HTTP_GET {
+		return fmt.Errorf("invalid callback_method: %s", consumer.CallbackMethod)
+	}
+	if err := utils.ValidateCallbackAuth(consumer.CallbackAuth); err != nil {
+		return fmt.Errorf("invalid callback_auth: %s", err.Error())
+	}
+	if err := utils.ValidateCallbackSigning(consumer.CallbackSigning); err != nil {
+		return fmt.Errorf("invalid callback_signing: %s", err.Error())
+	}
+	if err := utils.ValidateMetadataMode(consumer.MetadataMode); err != nil {
+		return fmt.Errorf("invalid metadata_mode: %s", err.Error())
+	}
+	if err := utils.ValidateBatchSettings(consumer.Batch); err != nil {
+		return fmt.Errorf("invalid batch: %s", err.Error())
+	}
+	if utils.BatchEnabled(consumer.Batch) && consumer.MetadataMode == models.METADATA_HEADERS {
+		return fmt.Errorf("metadata_mode %s cannot be used with batches", models.METADATA_HEADERS)
+	}
+	if err := utils.ValidateRateLimit(consumer.RateLimit); err != nil {
+		return fmt.Errorf("invalid rate_limit: %s", err.Error())
+	}
+	if err := utils.ValidateCircuitBreaker(consumer.CircuitBreaker); err != nil {
+		return fmt.Errorf("invalid circuit_breaker: %s", err.Error())
+	}
+	if err := utils.ValidateHttpClientProfile(consumer.HttpClient); err != nil {
+		return fmt.Errorf("invalid http_client: %s", err.Error())
+	}
+	if err := utils.ValidateCallbackTargets(consumer); err != nil {
+		return fmt.Errorf("invalid callback_targets: %s", err.Error())
+	}
+	if utils.BatchEnabled(consumer.Batch) && len(consumer.CallbackTargets) > 0 {
+		return fmt.Errorf("callback_targets cannot be used with batches")
+	}
+	if err := utils.ValidateRoutingRules(consumer.RoutingRules); err != nil {
+		return fmt.Errorf("invalid routing_rules: %s", err.Error())
+	}
+	if utils.BatchEnabled(consumer.Batch) && (len(consumer.RoutingRules) > 0 || consumer.DropUnrouted) {
+		return fmt.Errorf("routing_rules cannot be used with batches")
+	}
+	if err := utils.ValidateTransforms(consumer.Transforms); err != nil {
+		return fmt.Errorf("invalid transforms: %s", err.Error())
+	}
+	if err := utils.ValidatePayloadFormat(consumer.Payload); err != nil {
+		return fmt.Errorf("invalid payload: %s", err.Error())
+	}
+	if err := utils.ValidateTransport(consumer); err != nil {
+		return fmt.Errorf("invalid transport: %s", err.Error())
+	}
+	if utils.BatchEnabled(consumer.Batch) && consumer.Transport != "" && consumer.Transport != models.TRANSPORT_HTTP {
+		return fmt.Errorf("transport %s cannot be used with batches", consumer.Transport)
+	}
+	if consumer.Rpc.Enabled && utils.BatchEnabled(consumer.Batch) {
+		return fmt.Errorf("rpc cannot be used with batches")
+	}
+	if consumer.Rpc.Enabled && consumer.RetryMode == models.RETRY_MODE_TTL_QUEUE {
+		return fmt.Errorf("rpc cannot be used with retry_mode %s", models.RETRY_MODE_TTL_QUEUE)
+	}
+	if err := utils.ValidateDedupe(consumer.Dedupe); err != nil {
+		return fmt.Errorf("invalid dedupe: %s", err.Error())
+	}
+	if consumer.Qos < 0 {
+		return fmt.Errorf("invalid qos: %d", consumer.Qos)
+	}
+	if consumer.Concurrency < 0 || consumer.Concurrency > MAX_CONCURRENCY {
+		return fmt.Errorf("concurrency must be between 0 and %d", MAX_CONCURRENCY)
+	}
+	if utils.BatchEnabled(consumer.Batch) && consumer.Concurrency > 1 {
+		return fmt.Errorf("concurrency cannot be used with batches")
+	}
+	if consumer.RetryMode != models.RETRY_MODE_IN_PROCESS && consumer.RetryMode != models.RETRY_MODE_TTL_QUEUE {
+		return fmt.Errorf("unknown retry_mode: %s", consumer.RetryMode)
+	}
+	switch consumer.DeliveryMode {
+	case "", models.DELIVERY_AT_MOST_ONCE, models.DELIVERY_AT_LEAST_ONCE:
+	default:
+		return fmt.Errorf("unknown delivery_mode: %s", consumer.DeliveryMode)
+	}
+	if err := utils.ValidateFilter(consumer.Filter); err != nil {
+		return fmt.Errorf("invalid filter: %s", err.Error())
+	}
+	if err := utils.ValidateActiveWindows(consumer.ActiveWindows); err != nil {
+		return fmt.Errorf("invalid active_windows: %s", err.Error())
+	}
+	if consumer.Quarantine.MaxAttempts < 0 {
+		return fmt.Errorf("quarantine max_attempts must not be negative")
+	}
+	if err := utils.ValidatePartition(consumer.Partition, MAX_CONCURRENCY); err != nil {
+		return fmt.Errorf("invalid partition: %s", err.Error())
+	}
+	if utils.PartitionEnabled(consumer.Partition) {
+		// Lanes are the parallelism of the consumer and retry in place to keep
+		// the order of a key.
+		if utils.BatchEnabled(consumer.Batch) {
+			return fmt.Errorf("partition cannot be used with batches")
+		}
+		if consumer.Concurrency > 1 {
+			return fmt.Errorf("partition cannot be used with concurrency, set partition.lanes instead")
+		}
+		// The lanes of a consumer are shared by id, so a second channel would
+		// dispatch the same keys onto them.
+		if consumer.QueueCount > 1 {
+			return fmt.Errorf("partition cannot be used with queue_count above 1, set partition.lanes instead")
+		}
+		if consumer.RetryMode == models.RETRY_MODE_TTL_QUEUE {
+			return fmt.Errorf("partition cannot be used with retry_mode %s", models.RETRY_MODE_TTL_QUEUE)
+		}
+	}
+
+	return nil
+}
+
 // DeleteConsumer deletes a consumer from the database
 func DeleteConsumer(database *sql.DB, consumerID string) error {
 	const FUNCNAME = "DeleteConsumer"
 
-	_, err := database.Exec(`DELETE FROM consumers WHERE id = ?`, consumerID)
+	// Pending retry jobs go with the consumer, so none of them runs after the
+	// delete with default settings.
+	tx, err := database.Begin()
 	if err != nil {
+		logger.E(FUNCNAME, "failed to begin transaction.", err.Error())
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM consumers WHERE id = ?`, consumerID); err != nil {
+		tx.Rollback()
+		logger.E(FUNCNAME, "failed to delete consumer.", err.Error())
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM retry_jobs WHERE consumer_id = ?`, consumerID); err != nil {
+		tx.Rollback()
+		logger.E(FUNCNAME, "failed to delete retry jobs.", err.Error())
+		return err
+	}
+	if err = tx.Commit(); err != nil {
 		logger.E(FUNCNAME, "failed to delete consumer.", err.Error())
 		return err
 	}
+	if err = db.DeleteDedupeData(database, consumerID); err != nil {
+		logger.E(FUNCNAME, "failed to delete dedupe keys.", err.Error())
+	}
+	utils.RemoveFilterStats(consumerID)
+	if err = db.DeleteDeliveryAttemptData(database, consumerID); err != nil {
+		logger.E(FUNCNAME, "failed to delete delivery attempts.", err.Error())
+	}
+	if err = db.DeleteQuarantineData(database, consumerID); err != nil {
+		logger.E(FUNCNAME, "failed to delete quarantined messages.", err.Error())
+	}
 
 	return nil
 }
@@ -123,37 +265,15 @@ func DisableConsumer(database *sql.DB, consumerID string) error {
 	return nil
 }
 
-// FailedCallback represents a failed callback in the database
-type FailedCallback struct {
-	ID              int64     `json:"id"`
-	QueueName       string    `json:"queue_name"`
-	RequestData     string    `json:"request_data"`
-	ResponseCode    int       `json:"response_code"`
-	ResponseContent string    `json:"response_content"`
-	CreatedAt       time.Time `json:"created_at"`
-}
-
 // FetchFailedCallbacks fetches all failed callbacks from the database
-func FetchFailedCallbacks(database *sql.DB) ([]FailedCallback, error) {
+func FetchFailedCallbacks(database *sql.DB) ([]models.FailedCallback, error) {
 	const FUNCNAME = "FetchFailedCallbacks"
 
-	rows, err := database.Query("SELECT id, queue_name, request_data, response_code, response_content, created_at FROM url_failed ORDER BY created_at DESC")
+	callbacks, err := db.FetchFailedCallbacks(database)
 	if err != nil {
 		logger.E(FUNCNAME, "failed to query failed callbacks.", err.Error())
 		return nil, err
 	}
-	defer rows.Close()
-
-	var callbacks []FailedCallback
-	for rows.Next() {
-		var callback FailedCallback
-		err := rows.Scan(&callback.ID, &callback.QueueName, &callback.RequestData, &callback.ResponseCode, &callback.ResponseContent, &callback.CreatedAt)
-		if err != nil {
-			logger.E(FUNCNAME, "failed to scan failed callback.", err.Error())
-			return nil, err
-		}
-		callbacks = append(callbacks, callback)
-	}
 
 	return callbacks, nil
 }
@@ -163,55 +283,33 @@ func RetryFailedCallback(database *sql.DB, id int64) error {
 	const FUNCNAME = "RetryFailedCallback"
 
 	// Fetch the failed request details from the database
-	var requestURL, requestData, responseContent string
-	var responseCode int
-	var queueName string
-	err := database.QueryRow("SELECT request_url, request_data, response_code, response_content, queue_name FROM url_failed WHERE id = ?", id).Scan(&requestURL, &requestData, &responseCode, &responseContent, &queueName)
+	failed, err := db.FetchFailedCallback(database, id)
 	if err != nil {
 		logger.E(FUNCNAME, "failed to fetch failed request details", err.Error())
 		return err
 	}
 
-	// Delete the record first
+	// Retry with the owning consumer's policy, or the default one for records
+	// stored before failed callbacks were linked to consumers.
+	consumer := &models.ConsumerParams{Id: failed.ConsumerId, QueueName: failed.QueueName, RetryPolicy: utils.DefaultRetryPolicy}
+	if failed.ConsumerId != "" {
+		if c, err := db.FetchConsumer(database, failed.ConsumerId); err == nil {
+			consumer = c
+		}
+	}
+
+	// Queue the retry before deleting the record, so a failure never loses it
+	if err = scheduler.Enqueue(consumer, *failed); err != nil {
+		logger.E(FUNCNAME, "failed to enqueue retry job", err.Error())
+		return err
+	}
+
 	_, delErr := database.Exec("DELETE FROM url_failed WHERE id = ?", id)
 	if delErr != nil {
 		logger.E(FUNCNAME, "failed to delete record", delErr.Error())
 		return delErr
 	}
 
-	// Start a goroutine for retry logic
-	go func() {
-		retryIntervals := []time.Duration{5 * time.Second, 1 * time.Minute, 5 * time.Minute}
-		for _, interval := range retryIntervals {
-			time.Sleep(interval)
-			body, retryErr, statusCode := utils.HttpRequest(utils.HTTP_POST, nil, requestURL, requestData)
-			if retryErr == nil && statusCode == 200 {
-				var cbData models.CallbackData
-				if json.Unmarshal([]byte(body), &cbData) == nil && cbData.ErrorCode == 0 {
-					// Retry successful
-					logger.I(FUNCNAME, "retry successful for id", id)
-					return
-				}
-			}
-			// Update response content and code for potential re-insertion
-			responseContent = body
-			responseCode = statusCode
-			// Log retry attempt
-			logger.I(FUNCNAME, fmt.Sprintf("retry attempt failed for id %d, status: %d", id, statusCode))
-		}
-
-		// All retries failed, re-insert the failed request
-		_, err := database.Exec(`
-			INSERT INTO url_failed (request_url, request_data, response_code, response_content, queue_name)
-			VALUES (?, ?, ?, ?, ?)
-		`, requestURL, requestData, responseCode, responseContent, queueName)
-		if err != nil {
-			logger.E(FUNCNAME, "failed to re-insert failed request", err.Error())
-		}
-
-		logger.E(FUNCNAME, "all retry attempts failed for id", id)
-	}()
-
 	return nil
 }
 
@@ -250,15 +348,15 @@ func BulkActionFailedCallbacks(database *sql.DB, ids []int64, action string) err
 }
 
 // RegisterRoutes registers the API routes with the Fiber app
-func RegisterRoutes(app *fiber.App, db *sql.DB) {
+func RegisterRoutes(app *fiber.App, database *sql.DB) {
 	// Enable CORS
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "*", // You can specify allowed origins here
-		AllowHeaders: "Origin, Content-Type, Accept",
+		AllowHeaders: "Origin, Content-Type, Accept, Authorization",
 	}))
 
 	app.Get("/rabbitmq-config", func(c *fiber.Ctx) error {
-		config, err := FetchRabbitMQConfig(db)
+		config, err := FetchRabbitMQConfig(database)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
@@ -281,102 +379,48 @@ func RegisterRoutes(app *fiber.App, db *sql.DB) {
 			User:     config.User,
 			Password: config.Password,
 		}
-		if err := UpdateRabbitMQConfig(db, &rabbitMQConfig); err != nil {
+		if err := UpdateRabbitMQConfig(database, &rabbitMQConfig); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 		return c.JSON(fiber.Map{"message": "RabbitMQ configuration updated successfully"})
 	})
 
 	app.Get("/consumers", func(c *fiber.Ctx) error {
-		rows, err := db.Query("SELECT * FROM consumers")
+		consumers, err := db.FetchConsumers(database)
 		if err != nil {
 			logger.E("GET /consumers", "Error querying database", err.Error())
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Database query error"})
 		}
-		defer rows.Close()
-
-		var consumers []models.ConsumerParams
-		for rows.Next() {
-			var consumer models.ConsumerParams
-			err := rows.Scan(
-				&consumer.Id,
-				&consumer.Name,
-				&consumer.Status,
-				&consumer.QueueName,
-				&consumer.ExchangeName,
-				&consumer.RoutingKey,
-				&consumer.VHost,
-				&consumer.DeathQueue.QueueName,
-				&consumer.DeathQueue.BindExchange,
-				&consumer.DeathQueue.BindRoutingKey,
-				&consumer.DeathQueue.TTL,
-				&consumer.Callback,
-				&consumer.RetryMode,
-				&consumer.QueueCount,
-			)
-			if err != nil {
-				logger.E("GET /consumers", "Error scanning row", err.Error())
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error scanning database row"})
-			}
-			consumers = append(consumers, consumer)
-		}
 
-		if err := rows.Err(); err != nil {
-			logger.E("GET /consumers", "Error after iterating rows", err.Error())
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error after iterating rows"})
+		for i := range consumers {
+			consumers[i] = redactConsumer(consumers[i])
 		}
-
-		// If no consumers were found, return an empty array instead of null
-		if len(consumers) == 0 {
-			return c.JSON([]models.ConsumerParams{})
-		}
-
 		return c.JSON(consumers)
 	})
 
 	app.Put("/consumers/:id", func(c *fiber.Ctx) error {
-		var consumerData struct {
-			Name         string `json:"name"`
-			Status       string `json:"status"`
-			QueueName    string `json:"queue_name"`
-			ExchangeName string `json:"exchange_name"`
-			RoutingKey   string `json:"routing_key"`
-			Callback     string `json:"callback"`
-			DeathQueue   struct {
-				XDeathQueueName string `json:"x_death_queue_name"`
-				BindExchange    string `json:"bind_exchange"`
-				BindRoutingKey  string `json:"bind_routing_key"`
-				XMessageTTL     string `json:"x_message_ttl"`
-			} `json:"death_queue"`
-			QueueCount uint64 `json:"queue_count"`
-			RetryMode  string `json:"retry_mode"`
-			Vhost      string `json:"vhost"`
-		}
-
-		if err := c.BodyParser(&consumerData); err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		existing, err := FetchConsumer(database, c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		consumer := models.ConsumerParams{
-			Id:           c.Params("id"),
-			Name:         consumerData.Name,
-			Status:       consumerData.Status,
-			QueueName:    consumerData.QueueName,
-			ExchangeName: consumerData.ExchangeName,
-			RoutingKey:   consumerData.RoutingKey,
-			Callback:     consumerData.Callback,
-			DeathQueue: models.DeathQueueInfo{
-				QueueName:      consumerData.DeathQueue.XDeathQueueName,
-				BindExchange:   consumerData.DeathQueue.BindExchange,
-				BindRoutingKey: consumerData.DeathQueue.BindRoutingKey,
-				TTL:            consumerData.DeathQueue.XMessageTTL,
-			},
-			QueueCount: consumerData.QueueCount,
-			RetryMode:  consumerData.RetryMode,
-			VHost:      consumerData.Vhost,
+		// The request body replaces the consumer; only the secrets it sent back
+		// redacted are taken from the stored one.
+		var consumer models.ConsumerParams
+		if err := c.BodyParser(&consumer); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		consumer.Id = existing.Id
+		restoreCallbackURLs(&consumer, existing)
+		if consumer.CallbackAuth, err = utils.RestoreCallbackAuth(&consumer, existing); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid callback_auth: " + err.Error()})
+		}
+		consumer.CallbackSigning = utils.RestoreCallbackSigning(consumer.CallbackSigning, existing.CallbackSigning)
+		if err := validateConsumer(&consumer); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		if err := EditConsumer(db, &consumer); err != nil {
+		if err := EditConsumer(database, &consumer); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 
@@ -389,12 +433,12 @@ func RegisterRoutes(app *fiber.App, db *sql.DB) {
 		consumerID := c.Params("id")
 
 		// Fetch the consumer before deleting
-		consumer, err := FetchConsumer(db, consumerID)
+		consumer, err := FetchConsumer(database, consumerID)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		if err := DeleteConsumer(db, consumerID); err != nil {
+		if err := DeleteConsumer(database, consumerID); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 
@@ -405,7 +449,7 @@ func RegisterRoutes(app *fiber.App, db *sql.DB) {
 
 	app.Put("/consumers/:id/enable", func(c *fiber.Ctx) error {
 		consumerID := c.Params("id")
-		if err := EnableConsumer(db, consumerID); err != nil {
+		if err := EnableConsumer(database, consumerID); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 		return c.JSON(fiber.Map{"message": "Consumer enabled successfully"})
@@ -413,54 +457,22 @@ func RegisterRoutes(app *fiber.App, db *sql.DB) {
 
 	app.Put("/consumers/:id/disable", func(c *fiber.Ctx) error {
 		consumerID := c.Params("id")
-		if err := DisableConsumer(db, consumerID); err != nil {
+		if err := DisableConsumer(database, consumerID); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 		return c.JSON(fiber.Map{"message": "Consumer disabled successfully"})
 	})
 
 	app.Post("/consumers", func(c *fiber.Ctx) error {
-		var consumerData struct {
-			Name         string `json:"name"`
-			Status       string `json:"status"`
-			QueueName    string `json:"queue_name"`
-			ExchangeName string `json:"exchange_name"`
-			RoutingKey   string `json:"routing_key"`
-			Callback     string `json:"callback"`
-			DeathQueue   struct {
-				XDeathQueueName string `json:"x_death_queue_name"`
-				BindExchange    string `json:"bind_exchange"`
-				BindRoutingKey  string `json:"bind_routing_key"`
-				XMessageTTL     string `json:"x_message_ttl"`
-			} `json:"death_queue"`
-			QueueCount uint64 `json:"queue_count"`
-			RetryMode  string `json:"retry_mode"`
-			Vhost      string `json:"vhost"`
-		}
-
-		if err := c.BodyParser(&consumerData); err != nil {
+		var consumer models.ConsumerParams
+		if err := c.BodyParser(&consumer); err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
 		}
+		if err := validateConsumer(&consumer); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
 
-		consumer := models.ConsumerParams{
-			Name:         consumerData.Name,
-			Status:       consumerData.Status,
-			QueueName:    consumerData.QueueName,
-			ExchangeName: consumerData.ExchangeName,
-			RoutingKey:   consumerData.RoutingKey,
-			Callback:     consumerData.Callback,
-			DeathQueue: models.DeathQueueInfo{
-				QueueName:      consumerData.DeathQueue.XDeathQueueName,
-				BindExchange:   consumerData.DeathQueue.BindExchange,
-				BindRoutingKey: consumerData.DeathQueue.BindRoutingKey,
-				TTL:            consumerData.DeathQueue.XMessageTTL,
-			},
-			QueueCount: consumerData.QueueCount,
-			RetryMode:  consumerData.RetryMode,
-			VHost:      consumerData.Vhost,
-		}
-
-		id, err := AddConsumer(db, &consumer)
+		id, err := AddConsumer(database, &consumer)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
@@ -476,7 +488,7 @@ func RegisterRoutes(app *fiber.App, db *sql.DB) {
 
 	app.Put("/consumers/:id/restart", func(c *fiber.Ctx) error {
 		consumerID := c.Params("id")
-		consumer, err := FetchConsumer(db, consumerID)
+		consumer, err := FetchConsumer(database, consumerID)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
@@ -485,6 +497,141 @@ func RegisterRoutes(app *fiber.App, db *sql.DB) {
 		return c.JSON(fiber.Map{"message": "Consumer restarted successfully"})
 	})
 
+	app.Get("/consumers/:id/active-window", func(c *fiber.Ctx) error {
+		consumer, err := FetchConsumer(database, c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		active, next, err := utils.ActiveWindowState(consumer.ActiveWindows, time.Now())
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		state := models.ActiveWindowState{ConsumerId: consumer.Id, Active: active}
+		if !next.IsZero() {
+			state.NextTransition = &next
+		}
+		return c.JSON(state)
+	})
+
+	app.Post("/consumers/:id/evaluate-callback", func(c *fiber.Ctx) error {
+		var request struct {
+			StatusCode      int                     `json:"status_code"`
+			Body            string                  `json:"body"`
+			SuccessCriteria *models.SuccessCriteria `json:"success_criteria"`
+		}
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+
+		consumer, err := FetchConsumer(database, c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		// Criteria sent with the request are tried out instead of the stored ones
+		criteria := consumer.SuccessCriteria
+		if request.SuccessCriteria != nil {
+			criteria = *request.SuccessCriteria
+		}
+		if err := utils.ValidateSuccessCriteria(criteria); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(utils.EvaluateResponse(consumer, criteria, request.StatusCode, request.Body))
+	})
+
+	app.Post("/filters/test", func(c *fiber.Ctx) error {
+		var request struct {
+			Expression string                 `json:"expression"`
+			Body       json.RawMessage        `json:"body"`
+			Headers    map[string]interface{} `json:"headers"`
+			RoutingKey string                 `json:"routing_key"`
+			Exchange   string                 `json:"exchange"`
+			MessageId  string                 `json:"message_id"`
+		}
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if request.Expression == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "expression is required"})
+		}
+		if err := utils.ValidateFilter(request.Expression); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		metadata := &models.MessageMetadata{
+			RoutingKey: request.RoutingKey,
+			Exchange:   request.Exchange,
+			MessageId:  request.MessageId,
+			Headers:    request.Headers,
+		}
+		// The sample body is a JSON value, or a string holding the raw body.
+		body := string(request.Body)
+		var text string
+		if json.Unmarshal(request.Body, &text) == nil {
+			body = text
+		}
+		matched, err := utils.TestFilter(request.Expression, metadata, body)
+		if err != nil {
+			// A failing expression does not match at runtime either.
+			return c.JSON(fiber.Map{"matched": false, "error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"matched": matched})
+	})
+
+	app.Get("/filter-stats", func(c *fiber.Ctx) error {
+		return c.JSON(utils.FilterStats())
+	})
+
+	// The generated secret is only ever returned here, so rotating needs the
+	// admin token.
+	app.Post("/consumers/:id/signing/rotate", requireAdmin, func(c *fiber.Ctx) error {
+		var request struct {
+			Secret      string `json:"secret"`
+			GracePeriod string `json:"grace_period"`
+		}
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+
+		grace := 24 * time.Hour
+		if request.GracePeriod != "" {
+			var err error
+			if grace, err = time.ParseDuration(request.GracePeriod); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid grace_period"})
+			}
+		}
+
+		consumer, err := FetchConsumer(database, c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		secret := request.Secret
+		if secret == "" {
+			if secret, err = utils.NewSigningSecret(); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+		consumer.CallbackSigning = utils.RotateSigningSecret(consumer.CallbackSigning, secret, grace)
+
+		if err := EditConsumer(database, consumer); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		ConsumerNotificationChan <- ConsumerNotification{Type: "updated", Consumer: *consumer}
+
+		response := fiber.Map{
+			"message":          "Signing secret rotated successfully",
+			"callback_signing": utils.RedactCallbackSigning(consumer.CallbackSigning),
+		}
+		if request.Secret == "" {
+			response["secret"] = secret
+		}
+		return c.JSON(response)
+	})
+
 	app.Post("/test-rabbitmq-connection", func(c *fiber.Ctx) error {
 		var config struct {
 			Host     string `json:"host"`
@@ -511,10 +658,13 @@ func RegisterRoutes(app *fiber.App, db *sql.DB) {
 	})
 
 	app.Get("/failed-callbacks", func(c *fiber.Ctx) error {
-		callbacks, err := FetchFailedCallbacks(db)
+		callbacks, err := FetchFailedCallbacks(database)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
+		for i := range callbacks {
+			callbacks[i].RequestURL = utils.RedactURL(callbacks[i].RequestURL)
+		}
 		return c.JSON(callbacks)
 	})
 
@@ -523,7 +673,7 @@ func RegisterRoutes(app *fiber.App, db *sql.DB) {
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid ID"})
 		}
-		if err := RetryFailedCallback(db, int64(id)); err != nil {
+		if err := RetryFailedCallback(database, int64(id)); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 		return c.JSON(fiber.Map{"message": "Retry process initiated successfully"})
@@ -534,12 +684,92 @@ func RegisterRoutes(app *fiber.App, db *sql.DB) {
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid ID"})
 		}
-		if err := DeleteFailedCallback(db, int64(id)); err != nil {
+		if err := DeleteFailedCallback(database, int64(id)); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 		return c.JSON(fiber.Map{"message": "Callback deleted successfully"})
 	})
 
+	app.Get("/quarantine", func(c *fiber.Ctx) error {
+		messages, err := db.FetchQuarantinedMessages(database, c.Query("consumer_id"))
+		if err != nil {
+			logger.E("GET /quarantine", "Error querying database", err.Error())
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(messages)
+	})
+
+	app.Get("/quarantine/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid ID"})
+		}
+		msg, err := db.FetchQuarantined(database, int64(id))
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Quarantined message not found"})
+		} else if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(msg)
+	})
+
+	app.Post("/quarantine/:id/release", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid ID"})
+		}
+		msg, err := db.FetchQuarantined(database, int64(id))
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Quarantined message not found"})
+		} else if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		consumer, err := FetchConsumer(database, msg.ConsumerId)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		config, err := db.FetchRabbitMQConfig(database)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		// The message is only dropped from the quarantine once the broker has it.
+		if err := MQServer.ReleaseQuarantined(config, consumer.VHost, *msg); err != nil {
+			logger.E("POST /quarantine/:id/release", "Failed to release message", err.Error())
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := db.DeleteQuarantined(database, msg.ID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Message released to the queue successfully"})
+	})
+
+	app.Delete("/quarantine/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid ID"})
+		}
+		if err := db.DeleteQuarantined(database, int64(id)); err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Quarantined message not found"})
+		} else if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Quarantined message discarded successfully"})
+	})
+
+	app.Get("/retry-jobs", func(c *fiber.Ctx) error {
+		jobs, err := db.FetchRetryJobs(database)
+		if err != nil {
+			logger.E("GET /retry-jobs", "Error querying database", err.Error())
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		for i := range jobs {
+			jobs[i].RequestURL = utils.RedactURL(jobs[i].RequestURL)
+		}
+		return c.JSON(jobs)
+	})
+
 	app.Post("/failed-callbacks/bulk", func(c *fiber.Ctx) error {
 		var request struct {
 			IDs    []int64 `json:"ids"`
@@ -548,35 +778,192 @@ func RegisterRoutes(app *fiber.App, db *sql.DB) {
 		if err := c.BodyParser(&request); err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
 		}
-		if err := BulkActionFailedCallbacks(db, request.IDs, request.Action); err != nil {
+		if err := BulkActionFailedCallbacks(database, request.IDs, request.Action); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 		return c.JSON(fiber.Map{"message": "Bulk action completed successfully"})
 	})
+
+	app.Get("/circuit-breakers", func(c *fiber.Ctx) error {
+		return c.JSON(utils.BreakerStates())
+	})
+
+	app.Get("/lanes", func(c *fiber.Ctx) error {
+		return c.JSON(utils.LaneStates())
+	})
+
+	app.Get("/rate-limits", func(c *fiber.Ctx) error {
+		limits, err := db.FetchHostRateLimits(database)
+		if err != nil {
+			logger.E("GET /rate-limits", "Error querying database", err.Error())
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{
+			"hosts":          limits,
+			"host_state":     utils.HostThrottleStates(),
+			"consumer_state": utils.ConsumerThrottleStates(),
+		})
+	})
+
+	app.Put("/rate-limits/hosts/:host", func(c *fiber.Ctx) error {
+		var limit models.RateLimit
+		if err := c.BodyParser(&limit); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if err := utils.ValidateRateLimit(limit); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		host := strings.ToLower(c.Params("host"))
+		if err := db.SaveHostRateLimit(database, models.HostRateLimit{Host: host, RateLimit: limit}); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		utils.SetHostRateLimit(host, limit)
+
+		return c.JSON(fiber.Map{"message": "Host rate limit updated successfully"})
+	})
+
+	app.Delete("/rate-limits/hosts/:host", func(c *fiber.Ctx) error {
+		host := strings.ToLower(c.Params("host"))
+		if err := db.DeleteHostRateLimit(database, host); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		utils.SetHostRateLimit(host, models.RateLimit{})
+
+		return c.JSON(fiber.Map{"message": "Host rate limit deleted successfully"})
+	})
+
+	app.Get("/dedupe-stats", func(c *fiber.Ctx) error {
+		stats, err := db.FetchDedupeStats(database, time.Now())
+		if err != nil {
+			logger.E("GET /dedupe-stats", "Error querying database", err.Error())
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(stats)
+	})
+
+	app.Get("/schemas", func(c *fiber.Ctx) error {
+		schemas, err := db.FetchSchemas(database)
+		if err != nil {
+			logger.E("GET /schemas", "Error querying database", err.Error())
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(schemas)
+	})
+
+	app.Get("/schemas/:name", func(c *fiber.Ctx) error {
+		schema, err := db.FetchSchema(database, c.Params("name"))
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Schema not found"})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(schema)
+	})
+
+	app.Put("/schemas/:name", func(c *fiber.Ctx) error {
+		var schema models.Schema
+		if err := c.BodyParser(&schema); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		schema.Name = c.Params("name")
+		if err := utils.ValidateSchema(schema); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := db.SaveSchema(database, schema); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		utils.SetSchema(schema)
+
+		return c.JSON(fiber.Map{"message": "Schema saved successfully"})
+	})
+
+	app.Delete("/schemas/:name", func(c *fiber.Ctx) error {
+		name := c.Params("name")
+		consumers, err := db.FetchConsumers(database)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		for _, consumer := range consumers {
+			if consumer.Payload.Schema == name {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": fmt.Sprintf("Schema is used by consumer %s", consumer.Id)})
+			}
+		}
+
+		if err := db.DeleteSchema(database, name); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		utils.RemoveSchema(name)
+
+		return c.JSON(fiber.Map{"message": "Schema deleted successfully"})
+	})
+}
+
+// adminToken guards the endpoints that hand out secrets. They refuse every
+// request while it is empty.
+var adminToken string
+
+// SetAdminToken sets the bearer token of the admin-only endpoints.
+func SetAdminToken(token string) {
+	adminToken = token
+}
+
+// requireAdmin lets a request through only with the admin bearer token.
+func requireAdmin(c *fiber.Ctx) error {
+	if adminToken == "" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Admin token is not configured"})
+	}
+	token := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	return c.Next()
+}
+
+// redactConsumer hides the callback secrets of a consumer for API responses,
+// including the passwords in callback URLs such as amqp sink URLs.
+func redactConsumer(consumer models.ConsumerParams) models.ConsumerParams {
+	consumer.CallbackAuth = utils.RedactCallbackAuth(consumer.CallbackAuth)
+	consumer.CallbackSigning = utils.RedactCallbackSigning(consumer.CallbackSigning)
+	consumer.Callback = utils.RedactURL(consumer.Callback)
+	consumer.CallbackTargets = append([]models.CallbackTarget(nil), consumer.CallbackTargets...)
+	for i := range consumer.CallbackTargets {
+		consumer.CallbackTargets[i].URL = utils.RedactURL(consumer.CallbackTargets[i].URL)
+	}
+	consumer.RoutingRules = append([]models.RoutingRule(nil), consumer.RoutingRules...)
+	for i := range consumer.RoutingRules {
+		consumer.RoutingRules[i].Callback = utils.RedactURL(consumer.RoutingRules[i].Callback)
+	}
+	return consumer
+}
+
+// restoreCallbackURLs puts back the passwords of the stored callback URLs
+// that an update sent redacted.
+func restoreCallbackURLs(consumer, stored *models.ConsumerParams) {
+	urls := []string{stored.Callback}
+	for _, target := range stored.CallbackTargets {
+		urls = append(urls, target.URL)
+	}
+	for _, rule := range stored.RoutingRules {
+		urls = append(urls, rule.Callback)
+	}
+
+	consumer.Callback = utils.RestoreURL(consumer.Callback, urls...)
+	for i := range consumer.CallbackTargets {
+		consumer.CallbackTargets[i].URL = utils.RestoreURL(consumer.CallbackTargets[i].URL, urls...)
+	}
+	for i := range consumer.RoutingRules {
+		consumer.RoutingRules[i].Callback = utils.RestoreURL(consumer.RoutingRules[i].Callback, urls...)
+	}
 }
 
 // FetchConsumer fetches a single consumer from the database
 func FetchConsumer(database *sql.DB, consumerID string) (*models.ConsumerParams, error) {
 	const FUNCNAME = "FetchConsumer"
 
-	row := database.QueryRow("SELECT * FROM consumers WHERE id = ?", consumerID)
-	var consumer models.ConsumerParams
-	err := row.Scan(
-		&consumer.Id,
-		&consumer.Name,
-		&consumer.Status,
-		&consumer.QueueName,
-		&consumer.ExchangeName,
-		&consumer.RoutingKey,
-		&consumer.VHost,
-		&consumer.DeathQueue.QueueName,
-		&consumer.DeathQueue.BindExchange,
-		&consumer.DeathQueue.BindRoutingKey,
-		&consumer.DeathQueue.TTL,
-		&consumer.Callback,
-		&consumer.RetryMode,
-		&consumer.QueueCount,
-	)
+	consumer, err := db.FetchConsumer(database, consumerID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logger.E(FUNCNAME, "no consumer found with ID: "+consumerID)
@@ -586,7 +973,7 @@ func FetchConsumer(database *sql.DB, consumerID string) (*models.ConsumerParams,
 		return nil, err
 	}
 
-	return &consumer, nil
+	return consumer, nil
 }
 
 // ConsumerNotification is exported
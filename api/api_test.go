@@ -0,0 +1,87 @@
+package api
+
+import (
+	"go-rabbitmq-consumers/db"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newTestApp serves the API on a fresh database.
+func newTestApp(t *testing.T) *fiber.App {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	SetConsumerNotificationChan(make(chan ConsumerNotification, 10))
+
+	app := fiber.New()
+	RegisterRoutes(app, database)
+	return app
+}
+
+func request(t *testing.T, app *fiber.App, method, path, body string) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestCreateConsumerDeliveryMode(t *testing.T) {
+	app := newTestApp(t)
+
+	tests := []struct {
+		mode   string
+		status int
+	}{
+		{"", fiber.StatusCreated},
+		{"at_most_once", fiber.StatusCreated},
+		{"at_least_once", fiber.StatusCreated},
+		{"exactly_once", fiber.StatusBadRequest},
+		{"AT_LEAST_ONCE", fiber.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		body := `{"name":"orders","queue_name":"orders","callback":"http://127.0.0.1/hook","delivery_mode":"` + tt.mode + `"}`
+		if status := request(t, app, "POST", "/consumers", body); status != tt.status {
+			t.Errorf("delivery_mode %q: status %d, want %d", tt.mode, status, tt.status)
+		}
+	}
+}
+
+func TestUpdateConsumer(t *testing.T) {
+	app := newTestApp(t)
+
+	body := `{"name":"orders","queue_name":"orders","callback":"https://hooks.example.com/orders",` +
+		`"callback_headers":{"X-Tenant":"acme","X-Debug":"1"},"callback_auth":{"type":"bearer","token":"t0ken"}}`
+	if status := request(t, app, "POST", "/consumers", body); status != fiber.StatusCreated {
+		t.Fatalf("create: status %d", status)
+	}
+
+	// Headers left out of the update are removed, the redacted token is kept.
+	body = `{"name":"orders","queue_name":"orders","callback":"https://hooks.example.com/v2/orders",` +
+		`"callback_headers":{"X-Tenant":"acme"},"callback_auth":{"type":"bearer","token":"[redacted]"}}`
+	if status := request(t, app, "PUT", "/consumers/1", body); status != fiber.StatusOK {
+		t.Fatalf("update: status %d", status)
+	}
+	consumer, err := db.FetchConsumer(db.DB, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(consumer.CallbackHeaders) != 1 || consumer.CallbackAuth.Token != "t0ken" {
+		t.Fatalf("updated consumer %+v", consumer)
+	}
+
+	// Moved to another host, the token must be sent again.
+	body = `{"name":"orders","queue_name":"orders","callback":"https://attacker.example.com/orders",` +
+		`"callback_auth":{"type":"bearer","token":"[redacted]"}}`
+	if status := request(t, app, "PUT", "/consumers/1", body); status != fiber.StatusBadRequest {
+		t.Fatalf("update to another host: status %d", status)
+	}
+}
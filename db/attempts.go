@@ -0,0 +1,78 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// AddDeliveryAttempt counts one more delivery of a message by a consumer and
+// returns the count including it, and when the first one started. Times are
+// kept in unix milliseconds.
+func AddDeliveryAttempt(db *sql.DB, consumerID, key string, now time.Time) (int, time.Time, error) {
+	var (
+		attempts int
+		firstAt  int64
+	)
+	err := db.QueryRow(`
+		INSERT INTO delivery_attempts (consumer_id, message_key, attempts, first_at, updated_at) VALUES (?, ?, 1, ?, ?)
+		ON CONFLICT(consumer_id, message_key) DO UPDATE SET attempts = attempts + 1, updated_at = excluded.updated_at
+		RETURNING attempts, first_at
+	`, consumerID, key, now.UnixMilli(), now.UnixMilli()).Scan(&attempts, &firstAt)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return attempts, time.UnixMilli(firstAt), nil
+}
+
+// KeepDeliveryAttempts stores that a message was delivered attempts times by
+// a consumer, the first time at firstAt, unless a higher count is stored
+// already.
+func KeepDeliveryAttempts(db *sql.DB, consumerID, key string, attempts int, firstAt time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO delivery_attempts (consumer_id, message_key, attempts, first_at, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(consumer_id, message_key) DO UPDATE SET attempts = MAX(attempts, excluded.attempts), updated_at = excluded.updated_at
+	`, consumerID, key, attempts, firstAt.UnixMilli(), time.Now().UnixMilli())
+	return err
+}
+
+// FetchDeliveryAttempts returns how many deliveries of a message a consumer
+// counted so far.
+func FetchDeliveryAttempts(db *sql.DB, consumerID, key string) (int, error) {
+	var attempts int
+	err := db.QueryRow("SELECT attempts FROM delivery_attempts WHERE consumer_id = ? AND message_key = ?", consumerID, key).Scan(&attempts)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return attempts, err
+}
+
+// UndoDeliveryAttempt takes back the last counted delivery of a message.
+func UndoDeliveryAttempt(db *sql.DB, consumerID, key string) error {
+	if _, err := db.Exec("UPDATE delivery_attempts SET attempts = attempts - 1 WHERE consumer_id = ? AND message_key = ?", consumerID, key); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM delivery_attempts WHERE consumer_id = ? AND message_key = ? AND attempts <= 0", consumerID, key)
+	return err
+}
+
+// DeleteDeliveryAttempts forgets the count of a message that was settled.
+func DeleteDeliveryAttempts(db *sql.DB, consumerID, key string) error {
+	_, err := db.Exec("DELETE FROM delivery_attempts WHERE consumer_id = ? AND message_key = ?", consumerID, key)
+	return err
+}
+
+// DeleteStaleDeliveryAttempts removes the counts of messages not seen since
+// before and returns how many were removed.
+func DeleteStaleDeliveryAttempts(db *sql.DB, before time.Time) (int64, error) {
+	result, err := db.Exec("DELETE FROM delivery_attempts WHERE updated_at < ?", before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteDeliveryAttemptData forgets the counts of a deleted consumer.
+func DeleteDeliveryAttemptData(db *sql.DB, consumerID string) error {
+	_, err := db.Exec("DELETE FROM delivery_attempts WHERE consumer_id = ?", consumerID)
+	return err
+}
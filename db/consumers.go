@@ -0,0 +1,206 @@
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"go-rabbitmq-consumers/models"
+	"strings"
+)
+
+// consumerColumns is the column order shared by consumerFields, the consumer
+// queries and the INSERT/UPDATE statements. Keep it in sync with consumerFields.
+var consumerColumns = []string{
+	"name",
+	"status",
+	"queue_name",
+	"exchange_name",
+	"routing_key",
+	"vhost",
+	"death_queue_name",
+	"death_queue_bind_exchange",
+	"death_queue_bind_routing_key",
+	"death_queue_ttl",
+	"callback",
+	"retry_mode",
+	"queue_count",
+	"delivery_mode",
+	"retry_policy",
+	"success_criteria",
+	"callback_method",
+	"callback_headers",
+	"callback_auth",
+	"callback_signing",
+	"metadata_mode",
+	"batch",
+	"qos",
+	"concurrency",
+	"rate_limit",
+	"circuit_breaker",
+	"http_client",
+	"callback_targets",
+	"ack_policy",
+	"routing_rules",
+	"drop_unrouted",
+	"auto_decode_base64",
+	"transforms",
+	"payload",
+	"transport",
+	"grpc",
+	"sink",
+	"rpc",
+	"dedupe",
+	"partition",
+	"filter",
+	"active_windows",
+	"quarantine",
+}
+
+// nullString scans a nullable TEXT column into a plain string.
+type nullString struct {
+	s *string
+}
+
+func (n nullString) Scan(value interface{}) error {
+	var ns sql.NullString
+	if err := ns.Scan(value); err != nil {
+		return err
+	}
+	*n.s = ns.String
+	return nil
+}
+
+func (n nullString) Value() (driver.Value, error) {
+	return *n.s, nil
+}
+
+// jsonField stores a structured consumer setting as JSON in a TEXT column.
+// Empty columns leave the target at its zero value.
+type jsonField struct {
+	v interface{}
+}
+
+func (j jsonField) Scan(value interface{}) error {
+	var ns sql.NullString
+	if err := ns.Scan(value); err != nil {
+		return err
+	}
+	if ns.String == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(ns.String), j.v)
+}
+
+func (j jsonField) Value() (driver.Value, error) {
+	data, err := json.Marshal(j.v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// consumerFields returns the consumer fields in consumerColumns order. The
+// result is used both as Scan destinations and as statement arguments.
+func consumerFields(consumer *models.ConsumerParams) []interface{} {
+	return []interface{}{
+		&consumer.Name,
+		&consumer.Status,
+		&consumer.QueueName,
+		&consumer.ExchangeName,
+		&consumer.RoutingKey,
+		&consumer.VHost,
+		nullString{&consumer.DeathQueue.QueueName},
+		nullString{&consumer.DeathQueue.BindExchange},
+		nullString{&consumer.DeathQueue.BindRoutingKey},
+		nullString{&consumer.DeathQueue.TTL},
+		&consumer.Callback,
+		nullString{&consumer.RetryMode},
+		&consumer.QueueCount,
+		nullString{&consumer.DeliveryMode},
+		jsonField{&consumer.RetryPolicy},
+		jsonField{&consumer.SuccessCriteria},
+		nullString{&consumer.CallbackMethod},
+		jsonField{&consumer.CallbackHeaders},
+		jsonField{&consumer.CallbackAuth},
+		jsonField{&consumer.CallbackSigning},
+		nullString{&consumer.MetadataMode},
+		jsonField{&consumer.Batch},
+		&consumer.Qos,
+		&consumer.Concurrency,
+		jsonField{&consumer.RateLimit},
+		jsonField{&consumer.CircuitBreaker},
+		jsonField{&consumer.HttpClient},
+		jsonField{&consumer.CallbackTargets},
+		nullString{&consumer.AckPolicy},
+		jsonField{&consumer.RoutingRules},
+		&consumer.DropUnrouted,
+		&consumer.AutoDecodeBase64,
+		jsonField{&consumer.Transforms},
+		jsonField{&consumer.Payload},
+		nullString{&consumer.Transport},
+		jsonField{&consumer.Grpc},
+		jsonField{&consumer.Sink},
+		jsonField{&consumer.Rpc},
+		jsonField{&consumer.Dedupe},
+		jsonField{&consumer.Partition},
+		nullString{&consumer.Filter},
+		jsonField{&consumer.ActiveWindows},
+		jsonField{&consumer.Quarantine},
+	}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanConsumer(row rowScanner) (*models.ConsumerParams, error) {
+	var consumer models.ConsumerParams
+	dest := append([]interface{}{&consumer.Id}, consumerFields(&consumer)...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return &consumer, nil
+}
+
+// FetchConsumer fetches a single consumer by ID. It returns sql.ErrNoRows when
+// the consumer does not exist.
+func FetchConsumer(db *sql.DB, consumerID string) (*models.ConsumerParams, error) {
+	row := db.QueryRow("SELECT id, "+strings.Join(consumerColumns, ", ")+" FROM consumers WHERE id = ?", consumerID)
+	return scanConsumer(row)
+}
+
+// FetchConsumers fetches every consumer ordered by ID.
+func FetchConsumers(db *sql.DB) ([]models.ConsumerParams, error) {
+	rows, err := db.Query("SELECT id, " + strings.Join(consumerColumns, ", ") + " FROM consumers ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	consumers := []models.ConsumerParams{}
+	for rows.Next() {
+		consumer, err := scanConsumer(rows)
+		if err != nil {
+			return nil, err
+		}
+		consumers = append(consumers, *consumer)
+	}
+
+	return consumers, rows.Err()
+}
+
+// InsertConsumer stores a new consumer and returns its ID.
+func InsertConsumer(db *sql.DB, consumer *models.ConsumerParams) (int64, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(consumerColumns)), ", ")
+	result, err := db.Exec("INSERT INTO consumers ("+strings.Join(consumerColumns, ", ")+") VALUES ("+placeholders+")", consumerFields(consumer)...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// UpdateConsumer overwrites every stored field of an existing consumer.
+func UpdateConsumer(db *sql.DB, consumer *models.ConsumerParams) error {
+	_, err := db.Exec("UPDATE consumers SET "+strings.Join(consumerColumns, " = ?, ")+" = ? WHERE id = ?", append(consumerFields(consumer), consumer.Id)...)
+	return err
+}
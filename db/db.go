@@ -15,7 +15,8 @@ func InitDB(dbPath string) (*sql.DB, error) {
 	const FUNCNAME = "InitDB"
 
 	var err error
-	DB, err = sql.Open("sqlite3", dbPath)
+	// Wait for locks instead of failing, the API and the retry workers write concurrently
+	DB, err = sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
 	if err != nil {
 		logger.E(FUNCNAME, "failed to open SQLite database.", err.Error())
 		return nil, err
@@ -58,6 +59,62 @@ func InitDB(dbPath string) (*sql.DB, error) {
 			queue_name TEXT,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		);`,
+		`CREATE TABLE IF NOT EXISTS retry_jobs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			consumer_id TEXT,
+			queue_name TEXT,
+			request_url TEXT,
+			request_data TEXT,
+			attempt INTEGER DEFAULT 0,
+			first_failed_at INTEGER,
+			next_run_at INTEGER,
+			response_code INTEGER DEFAULT 0,
+			response_content TEXT DEFAULT '',
+			status TEXT DEFAULT 'pending'
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_retry_jobs_due ON retry_jobs (status, next_run_at);`,
+		`CREATE TABLE IF NOT EXISTS host_rate_limits (
+			host TEXT PRIMARY KEY,
+			rate REAL,
+			burst INTEGER DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS dedupe_keys (
+			consumer_id TEXT,
+			key TEXT,
+			expires_at INTEGER,
+			PRIMARY KEY (consumer_id, key)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_dedupe_keys_expires ON dedupe_keys (expires_at);`,
+		`CREATE TABLE IF NOT EXISTS dedupe_hits (
+			consumer_id TEXT PRIMARY KEY,
+			hits INTEGER DEFAULT 0,
+			last_hit_at INTEGER DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS delivery_attempts (
+			consumer_id TEXT,
+			message_key TEXT,
+			attempts INTEGER DEFAULT 0,
+			first_at INTEGER,
+			updated_at INTEGER,
+			PRIMARY KEY (consumer_id, message_key)
+		);`,
+		`CREATE TABLE IF NOT EXISTS quarantine (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			consumer_id TEXT,
+			queue_name TEXT,
+			body TEXT,
+			base64 INTEGER DEFAULT 0,
+			metadata TEXT,
+			attempts INTEGER DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_quarantine_consumer ON quarantine (consumer_id);`,
+		`CREATE TABLE IF NOT EXISTS schemas (
+			name TEXT PRIMARY KEY,
+			format TEXT,
+			definition TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
 	}
 
 	for _, sqlStmt := range createTableSQLs {
@@ -68,12 +125,108 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		}
 	}
 
+	if err = addMissingColumns(DB); err != nil {
+		logger.E(FUNCNAME, "failed to migrate tables.", err.Error())
+		return nil, err
+	}
+
 	// Insert default data if tables are empty
 	insertDefaultData(DB)
 
 	return DB, nil
 }
 
+// columnMigrations lists the columns added after the initial schema. They are
+// applied on startup so existing rch.db files keep working.
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"consumers", "delivery_mode", "TEXT DEFAULT ''"},
+	{"consumers", "retry_policy", "TEXT DEFAULT ''"},
+	{"consumers", "success_criteria", "TEXT DEFAULT ''"},
+	{"consumers", "callback_method", "TEXT DEFAULT ''"},
+	{"consumers", "callback_headers", "TEXT DEFAULT ''"},
+	{"consumers", "callback_auth", "TEXT DEFAULT ''"},
+	{"consumers", "callback_signing", "TEXT DEFAULT ''"},
+	{"consumers", "metadata_mode", "TEXT DEFAULT ''"},
+	{"consumers", "batch", "TEXT DEFAULT ''"},
+	{"consumers", "qos", "INTEGER DEFAULT 0"},
+	{"consumers", "concurrency", "INTEGER DEFAULT 0"},
+	{"consumers", "rate_limit", "TEXT DEFAULT ''"},
+	{"consumers", "circuit_breaker", "TEXT DEFAULT ''"},
+	{"consumers", "http_client", "TEXT DEFAULT ''"},
+	{"consumers", "callback_targets", "TEXT DEFAULT ''"},
+	{"consumers", "ack_policy", "TEXT DEFAULT ''"},
+	{"consumers", "routing_rules", "TEXT DEFAULT ''"},
+	{"consumers", "drop_unrouted", "INTEGER DEFAULT 0"},
+	{"consumers", "auto_decode_base64", "INTEGER DEFAULT 0"},
+	{"consumers", "transforms", "TEXT DEFAULT ''"},
+	{"consumers", "payload", "TEXT DEFAULT ''"},
+	{"consumers", "transport", "TEXT DEFAULT ''"},
+	{"consumers", "grpc", "TEXT DEFAULT ''"},
+	{"consumers", "sink", "TEXT DEFAULT ''"},
+	{"consumers", "rpc", "TEXT DEFAULT ''"},
+	{"consumers", "dedupe", "TEXT DEFAULT ''"},
+	{"consumers", "partition", "TEXT DEFAULT ''"},
+	{"consumers", "filter", "TEXT DEFAULT ''"},
+	{"consumers", "active_windows", "TEXT DEFAULT ''"},
+	{"consumers", "quarantine", "TEXT DEFAULT ''"},
+	{"url_failed", "consumer_id", "TEXT DEFAULT ''"},
+	{"url_failed", "metadata", "TEXT DEFAULT ''"},
+	{"url_failed", "reason", "TEXT DEFAULT ''"},
+	{"retry_jobs", "metadata", "TEXT DEFAULT ''"},
+	{"quarantine", "exchange", "TEXT DEFAULT ''"},
+	{"quarantine", "routing_key", "TEXT DEFAULT ''"},
+	{"quarantine", "reply_to", "TEXT DEFAULT ''"},
+}
+
+func addMissingColumns(db *sql.DB) error {
+	const FUNCNAME = "addMissingColumns"
+
+	columns := map[string]map[string]bool{}
+	for _, m := range columnMigrations {
+		if columns[m.table] == nil {
+			existing, err := tableColumns(db, m.table)
+			if err != nil {
+				logger.E(FUNCNAME, "failed to read columns of", m.table, err.Error())
+				return err
+			}
+			columns[m.table] = existing
+		}
+		if columns[m.table][m.column] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)); err != nil {
+			logger.E(FUNCNAME, "failed to add column", m.table, m.column, err.Error())
+			return err
+		}
+		logger.I(FUNCNAME, "added column", m.table, m.column)
+	}
+
+	return nil
+}
+
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+
+	return columns, rows.Err()
+}
+
 func insertDefaultData(db *sql.DB) {
 	const FUNCNAME = "insertDefaultData"
 
@@ -127,31 +280,13 @@ func FetchRabbitMQConfig(db *sql.DB) (*models.RabbitMQConfig, error) {
 func FetchConsumersConfig(db *sql.DB) (*models.RabbitMQConsumers, error) {
 	const FUNCNAME = "FetchConsumersConfig"
 
-	rows, err := db.Query("SELECT id, name, status, queue_name, exchange_name, routing_key, vhost, death_queue_name, death_queue_bind_exchange, death_queue_bind_routing_key, death_queue_ttl, callback, retry_mode, queue_count FROM consumers")
+	consumers, err := FetchConsumers(db)
 	if err != nil {
 		logger.E(FUNCNAME, "failed to query consumers from SQLite database.", err.Error())
 		return nil, err
 	}
-	defer rows.Close()
-
-	consumersConf := &models.RabbitMQConsumers{}
-	for rows.Next() {
-		var consumer models.ConsumerParams
-		var deathQueueName, deathQueueBindExchange, deathQueueBindRoutingKey, retryMode sql.NullString
-		var deathQueueTTL string
-		err = rows.Scan(&consumer.Id, &consumer.Name, &consumer.Status, &consumer.QueueName, &consumer.ExchangeName, &consumer.RoutingKey, &consumer.VHost, &deathQueueName, &deathQueueBindExchange, &deathQueueBindRoutingKey, &deathQueueTTL, &consumer.Callback, &retryMode, &consumer.QueueCount)
-		if err != nil {
-			logger.E(FUNCNAME, "failed to scan consumer row.", err.Error())
-			return nil, err
-		}
-		consumer.DeathQueue.QueueName = deathQueueName.String
-		consumer.DeathQueue.BindExchange = deathQueueBindExchange.String
-		consumer.DeathQueue.BindRoutingKey = deathQueueBindRoutingKey.String
-		consumer.DeathQueue.TTL = deathQueueTTL // Adjusted to handle TEXT type
-		consumer.RetryMode = retryMode.String
-		consumersConf.Consumers = append(consumersConf.Consumers, consumer)
-	}
 
+	consumersConf := &models.RabbitMQConsumers{Consumers: consumers}
 	return consumersConf, nil
 }
 
@@ -188,19 +323,3 @@ func UpdateRabbitMQConfig(db *sql.DB, config models.RabbitMQConfig) error {
 
 	return nil
 }
-
-func SaveFailedRequest(requestURL, requestData, responseBody string, statusCode int, queueName string) error {
-	const FUNCNAME = "SaveFailedRequest"
-
-	_, err := DB.Exec(`
-		INSERT INTO url_failed (request_url, request_data, response_code, response_content, queue_name)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, requestURL, requestData, statusCode, responseBody, queueName)
-
-	if err != nil {
-		logger.E(FUNCNAME, "Failed to save failed request", err.Error())
-		return err
-	}
-
-	return nil
-}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"database/sql"
+	"go-rabbitmq-consumers/models"
+	"time"
+)
+
+// ClaimDedupeKey records that a consumer saw key until now plus window. It
+// returns false when the key was already seen and has not expired yet.
+func ClaimDedupeKey(db *sql.DB, consumerID, key string, now time.Time, window time.Duration) (bool, error) {
+	result, err := db.Exec(`
+		INSERT INTO dedupe_keys (consumer_id, key, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(consumer_id, key) DO UPDATE SET expires_at = excluded.expires_at
+		WHERE dedupe_keys.expires_at <= ?
+	`, consumerID, key, now.Add(window).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ReleaseDedupeKey gives up the claim on a key, for a message that goes back
+// to the queue before it reached a callback.
+func ReleaseDedupeKey(db *sql.DB, consumerID, key string) error {
+	_, err := db.Exec("DELETE FROM dedupe_keys WHERE consumer_id = ? AND key = ?", consumerID, key)
+	return err
+}
+
+// AddDedupeHit counts a duplicate dropped by a consumer.
+func AddDedupeHit(db *sql.DB, consumerID string, now time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO dedupe_hits (consumer_id, hits, last_hit_at) VALUES (?, 1, ?)
+		ON CONFLICT(consumer_id) DO UPDATE SET hits = hits + 1, last_hit_at = excluded.last_hit_at
+	`, consumerID, now.UnixMilli())
+	return err
+}
+
+// DeleteExpiredDedupeKeys removes the keys whose window ended before now and
+// returns how many were removed.
+func DeleteExpiredDedupeKeys(db *sql.DB, now time.Time) (int64, error) {
+	result, err := db.Exec("DELETE FROM dedupe_keys WHERE expires_at <= ?", now.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// FetchDedupeStats fetches the duplicate counts and the number of keys still
+// in their window of every consumer that has either.
+func FetchDedupeStats(db *sql.DB, now time.Time) ([]models.DedupeStats, error) {
+	rows, err := db.Query(`
+		SELECT consumer_id, SUM(hits), MAX(last_hit_at), SUM(active_keys) FROM (
+			SELECT consumer_id, hits, last_hit_at, 0 AS active_keys FROM dedupe_hits
+			UNION ALL
+			SELECT consumer_id, 0, 0, COUNT(*) FROM dedupe_keys WHERE expires_at > ? GROUP BY consumer_id
+		) GROUP BY consumer_id ORDER BY consumer_id
+	`, now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []models.DedupeStats{}
+	for rows.Next() {
+		var s models.DedupeStats
+		if err := rows.Scan(&s.ConsumerId, &s.Hits, &s.LastHitAt, &s.ActiveKeys); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+
+	return stats, rows.Err()
+}
+
+// DeleteDedupeData forgets the keys and counts of a deleted consumer.
+func DeleteDedupeData(db *sql.DB, consumerID string) error {
+	if _, err := db.Exec("DELETE FROM dedupe_keys WHERE consumer_id = ?", consumerID); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM dedupe_hits WHERE consumer_id = ?", consumerID)
+	return err
+}
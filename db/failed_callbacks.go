@@ -0,0 +1,60 @@
+package db
+
+import (
+	"database/sql"
+	"go-rabbitmq-consumers/logger"
+	"go-rabbitmq-consumers/models"
+)
+
+const failedCallbackColumns = "id, IFNULL(consumer_id, ''), queue_name, request_url, request_data, response_code, response_content, IFNULL(reason, ''), metadata, created_at"
+
+func scanFailedCallback(row rowScanner) (*models.FailedCallback, error) {
+	var callback models.FailedCallback
+	err := row.Scan(&callback.ID, &callback.ConsumerId, &callback.QueueName, &callback.RequestURL, &callback.RequestData, &callback.ResponseCode, &callback.ResponseContent, &callback.Reason, jsonField{&callback.Metadata}, &callback.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &callback, nil
+}
+
+func SaveFailedRequest(failed models.FailedCallback) error {
+	const FUNCNAME = "SaveFailedRequest"
+
+	_, err := DB.Exec(`
+		INSERT INTO url_failed (request_url, request_data, response_code, response_content, queue_name, consumer_id, reason, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, failed.RequestURL, failed.RequestData, failed.ResponseCode, failed.ResponseContent, failed.QueueName, failed.ConsumerId, failed.Reason, jsonField{&failed.Metadata})
+
+	if err != nil {
+		logger.E(FUNCNAME, "Failed to save failed request", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// FetchFailedCallback fetches a single failed callback by ID. It returns
+// sql.ErrNoRows when the record does not exist.
+func FetchFailedCallback(db *sql.DB, id int64) (*models.FailedCallback, error) {
+	return scanFailedCallback(db.QueryRow("SELECT "+failedCallbackColumns+" FROM url_failed WHERE id = ?", id))
+}
+
+// FetchFailedCallbacks fetches every failed callback, newest first.
+func FetchFailedCallbacks(db *sql.DB) ([]models.FailedCallback, error) {
+	rows, err := db.Query("SELECT " + failedCallbackColumns + " FROM url_failed ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	callbacks := []models.FailedCallback{}
+	for rows.Next() {
+		callback, err := scanFailedCallback(rows)
+		if err != nil {
+			return nil, err
+		}
+		callbacks = append(callbacks, *callback)
+	}
+
+	return callbacks, rows.Err()
+}
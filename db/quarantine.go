@@ -0,0 +1,71 @@
+package db
+
+import (
+	"database/sql"
+	"go-rabbitmq-consumers/models"
+)
+
+const quarantineColumns = "id, consumer_id, queue_name, body, base64, metadata, attempts, created_at, exchange, routing_key, reply_to"
+
+func scanQuarantined(row rowScanner) (*models.QuarantinedMessage, error) {
+	var msg models.QuarantinedMessage
+	err := row.Scan(&msg.ID, &msg.ConsumerId, &msg.QueueName, &msg.Body, &msg.Base64, jsonField{&msg.Metadata}, &msg.Attempts, &msg.CreatedAt, &msg.Exchange, &msg.RoutingKey, &msg.ReplyTo)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// SaveQuarantined stores a poison message in the quarantine.
+func SaveQuarantined(db *sql.DB, msg models.QuarantinedMessage) error {
+	_, err := db.Exec(`
+		INSERT INTO quarantine (consumer_id, queue_name, body, base64, metadata, attempts, exchange, routing_key, reply_to)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, msg.ConsumerId, msg.QueueName, msg.Body, msg.Base64, jsonField{&msg.Metadata}, msg.Attempts, msg.Exchange, msg.RoutingKey, msg.ReplyTo)
+	return err
+}
+
+// FetchQuarantined fetches a single quarantined message by ID. It returns
+// sql.ErrNoRows when the message does not exist.
+func FetchQuarantined(db *sql.DB, id int64) (*models.QuarantinedMessage, error) {
+	return scanQuarantined(db.QueryRow("SELECT "+quarantineColumns+" FROM quarantine WHERE id = ?", id))
+}
+
+// FetchQuarantinedMessages fetches the quarantined messages of a consumer, or
+// of every consumer when consumerID is empty, newest first.
+func FetchQuarantinedMessages(db *sql.DB, consumerID string) ([]models.QuarantinedMessage, error) {
+	rows, err := db.Query("SELECT "+quarantineColumns+" FROM quarantine WHERE ? = '' OR consumer_id = ? ORDER BY id DESC", consumerID, consumerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []models.QuarantinedMessage{}
+	for rows.Next() {
+		msg, err := scanQuarantined(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *msg)
+	}
+	return messages, rows.Err()
+}
+
+// DeleteQuarantined removes a released or discarded message. It returns
+// sql.ErrNoRows when the message does not exist.
+func DeleteQuarantined(db *sql.DB, id int64) error {
+	result, err := db.Exec("DELETE FROM quarantine WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteQuarantineData removes the quarantined messages of a deleted consumer.
+func DeleteQuarantineData(db *sql.DB, consumerID string) error {
+	_, err := db.Exec("DELETE FROM quarantine WHERE consumer_id = ?", consumerID)
+	return err
+}
@@ -0,0 +1,38 @@
+package db
+
+import (
+	"database/sql"
+	"go-rabbitmq-consumers/models"
+)
+
+// FetchHostRateLimits fetches the rate limits configured per callback host.
+func FetchHostRateLimits(db *sql.DB) ([]models.HostRateLimit, error) {
+	rows, err := db.Query("SELECT host, rate, burst FROM host_rate_limits ORDER BY host")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	limits := []models.HostRateLimit{}
+	for rows.Next() {
+		var limit models.HostRateLimit
+		if err := rows.Scan(&limit.Host, &limit.Rate, &limit.Burst); err != nil {
+			return nil, err
+		}
+		limits = append(limits, limit)
+	}
+
+	return limits, rows.Err()
+}
+
+// SaveHostRateLimit creates or replaces the rate limit of a callback host.
+func SaveHostRateLimit(db *sql.DB, limit models.HostRateLimit) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO host_rate_limits (host, rate, burst) VALUES (?, ?, ?)", limit.Host, limit.Rate, limit.Burst)
+	return err
+}
+
+// DeleteHostRateLimit removes the rate limit of a callback host.
+func DeleteHostRateLimit(db *sql.DB, host string) error {
+	_, err := db.Exec("DELETE FROM host_rate_limits WHERE host = ?", host)
+	return err
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"database/sql"
+	"go-rabbitmq-consumers/models"
+)
+
+const (
+	RETRY_JOB_PENDING = "pending"
+	RETRY_JOB_RUNNING = "running"
+)
+
+const retryJobColumns = "id, consumer_id, queue_name, request_url, request_data, attempt, first_failed_at, next_run_at, response_code, response_content, status, metadata"
+
+func scanRetryJob(row rowScanner) (*models.RetryJob, error) {
+	var job models.RetryJob
+	err := row.Scan(&job.Id, &job.ConsumerId, &job.QueueName, &job.RequestURL, &job.RequestData, &job.Attempt, &job.FirstFailedAt, &job.NextRunAt, &job.ResponseCode, &job.ResponseContent, &job.Status, jsonField{&job.Metadata})
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// InsertRetryJob stores a pending retry job and returns its ID.
+func InsertRetryJob(db *sql.DB, job *models.RetryJob) (int64, error) {
+	result, err := db.Exec(`INSERT INTO retry_jobs (consumer_id, queue_name, request_url, request_data, attempt, first_failed_at, next_run_at, response_code, response_content, status, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		job.ConsumerId, job.QueueName, job.RequestURL, job.RequestData, job.Attempt, job.FirstFailedAt, job.NextRunAt, job.ResponseCode, job.ResponseContent, RETRY_JOB_PENDING, jsonField{&job.Metadata})
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// ClaimDueRetryJobs marks up to limit pending jobs due at or before now as
+// running and returns them.
+func ClaimDueRetryJobs(db *sql.DB, now int64, limit int) ([]models.RetryJob, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT "+retryJobColumns+" FROM retry_jobs WHERE status = ? AND next_run_at <= ? ORDER BY next_run_at LIMIT ?", RETRY_JOB_PENDING, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []models.RetryJob{}
+	for rows.Next() {
+		job, err := scanRetryJob(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+	rows.Close()
+
+	for i := range jobs {
+		if _, err = tx.Exec("UPDATE retry_jobs SET status = ? WHERE id = ?", RETRY_JOB_RUNNING, jobs[i].Id); err != nil {
+			return nil, err
+		}
+		jobs[i].Status = RETRY_JOB_RUNNING
+	}
+
+	return jobs, tx.Commit()
+}
+
+// RescheduleRetryJob records a failed attempt and puts the job back to pending.
+func RescheduleRetryJob(db *sql.DB, job *models.RetryJob) error {
+	_, err := db.Exec("UPDATE retry_jobs SET attempt = ?, next_run_at = ?, response_code = ?, response_content = ?, status = ? WHERE id = ?",
+		job.Attempt, job.NextRunAt, job.ResponseCode, job.ResponseContent, RETRY_JOB_PENDING, job.Id)
+	return err
+}
+
+// DeleteRetryJob removes a finished job.
+func DeleteRetryJob(db *sql.DB, id int64) error {
+	_, err := db.Exec("DELETE FROM retry_jobs WHERE id = ?", id)
+	return err
+}
+
+// ResetRunningRetryJobs puts jobs left running by a previous process back to
+// pending so they are picked up again.
+func ResetRunningRetryJobs(db *sql.DB) (int64, error) {
+	result, err := db.Exec("UPDATE retry_jobs SET status = ? WHERE status = ?", RETRY_JOB_PENDING, RETRY_JOB_RUNNING)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// FetchRetryJobs returns every queued retry job ordered by next run time.
+func FetchRetryJobs(db *sql.DB) ([]models.RetryJob, error) {
+	rows, err := db.Query("SELECT " + retryJobColumns + " FROM retry_jobs ORDER BY next_run_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []models.RetryJob{}
+	for rows.Next() {
+		job, err := scanRetryJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+
+	return jobs, rows.Err()
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"database/sql"
+	"go-rabbitmq-consumers/models"
+)
+
+const schemaColumns = "name, format, definition, created_at"
+
+func scanSchema(row rowScanner) (*models.Schema, error) {
+	var schema models.Schema
+	if err := row.Scan(&schema.Name, &schema.Format, &schema.Definition, &schema.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// FetchSchema fetches a single payload schema by name. It returns
+// sql.ErrNoRows when the schema does not exist.
+func FetchSchema(db *sql.DB, name string) (*models.Schema, error) {
+	return scanSchema(db.QueryRow("SELECT "+schemaColumns+" FROM schemas WHERE name = ?", name))
+}
+
+// FetchSchemas fetches every payload schema ordered by name.
+func FetchSchemas(db *sql.DB) ([]models.Schema, error) {
+	rows, err := db.Query("SELECT " + schemaColumns + " FROM schemas ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schemas := []models.Schema{}
+	for rows.Next() {
+		schema, err := scanSchema(rows)
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, *schema)
+	}
+
+	return schemas, rows.Err()
+}
+
+// SaveSchema creates or replaces a payload schema.
+func SaveSchema(db *sql.DB, schema models.Schema) error {
+	_, err := db.Exec(`
+		INSERT INTO schemas (name, format, definition) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET format = excluded.format, definition = excluded.definition
+	`, schema.Name, schema.Format, schema.Definition)
+	return err
+}
+
+// DeleteSchema removes a payload schema.
+func DeleteSchema(db *sql.DB, name string) error {
+	_, err := db.Exec("DELETE FROM schemas WHERE name = ?", name)
+	return err
+}
@@ -6,6 +6,10 @@ import (
 	"go-rabbitmq-consumers/api"
 	"go-rabbitmq-consumers/db"
 	"go-rabbitmq-consumers/logger"
+	"go-rabbitmq-consumers/scheduler"
+	"go-rabbitmq-consumers/utils"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -21,8 +25,33 @@ var (
 	RetryServiceURL          string
 	ConsumerNotificationChan chan api.ConsumerNotification
 	ConsumersMutex           sync.RWMutex
+	// WindowedConsumers holds the running consumers with active windows, in or
+	// out of their window, for watchActiveWindows.
+	WindowedConsumers map[string]models.ConsumerParams
 )
 
+// RetryWorkers bounds how many retry jobs run at the same time.
+const RetryWorkers = 8
+
+// DedupeCleanupInterval is how often expired dedupe keys are removed.
+const DedupeCleanupInterval = 10 * time.Minute
+
+// AdminTokenEnv names the environment variable holding the bearer token of
+// the admin-only API endpoints, such as signing secret rotation.
+const AdminTokenEnv = "RCH_ADMIN_TOKEN"
+
+// ExecSinkCommandsEnv names the environment variable listing, separated like
+// PATH, the programs exec sinks may run.
+const ExecSinkCommandsEnv = "RCH_EXEC_SINK_COMMANDS"
+
+// FileSinkDirEnv names the environment variable holding the directory file
+// sinks write in.
+const FileSinkDirEnv = "RCH_FILE_SINK_DIR"
+
+// WindowCheckInterval is the longest time between two checks of the active
+// windows.
+const WindowCheckInterval = time.Minute
+
 func init_config() {
 	const FUNCNAME = "init_config"
 	var err error
@@ -57,10 +86,34 @@ func init_config() {
 		logger.E(FUNCNAME, "failed to fetch RetryServiceURL.", err.Error())
 		panic(err)
 	}
+
+	hostRateLimits, err := db.FetchHostRateLimits(database)
+	if err != nil {
+		logger.E(FUNCNAME, "failed to fetch host rate limits.", err.Error())
+		panic(err)
+	}
+	for _, limit := range hostRateLimits {
+		utils.SetHostRateLimit(limit.Host, limit.RateLimit)
+	}
+
+	utils.SetExecSinkCommands(filepath.SplitList(os.Getenv(ExecSinkCommandsEnv)))
+	utils.SetFileSinkDir(os.Getenv(FileSinkDirEnv))
+
+	schemas, err := db.FetchSchemas(database)
+	if err != nil {
+		logger.E(FUNCNAME, "failed to fetch payload schemas.", err.Error())
+		panic(err)
+	}
+	for _, schema := range schemas {
+		if err := utils.SetSchema(schema); err != nil {
+			logger.E(FUNCNAME, "failed to load payload schema", schema.Name, err.Error())
+		}
+	}
 }
 
 func init() {
 	ConsumersPool = make(map[string]*MQServer.RabbitMQServer)
+	WindowedConsumers = make(map[string]models.ConsumerParams)
 	ConsumerNotificationChan = make(chan api.ConsumerNotification, 100)
 }
 
@@ -76,6 +129,19 @@ func start_consumer(consumer_config models.ConsumerParams) {
 		return
 	}
 
+	if utils.ActiveWindowsEnabled(consumer_config.ActiveWindows) {
+		WindowedConsumers[consumer_config.Id] = consumer_config
+		active, next, err := utils.ActiveWindowState(consumer_config.ActiveWindows, time.Now())
+		if err != nil {
+			logger.E(FUNCNAME, fmt.Sprintf("invalid active windows, consumer would not start. queuename=%s, error:%s", consumer_config.QueueName, err.Error()))
+			return
+		}
+		if !active {
+			logger.I(FUNCNAME, fmt.Sprintf("consumer is outside its active windows until %s. queuename=%s", next.Format(time.RFC3339), consumer_config.QueueName))
+			return
+		}
+	}
+
 	if consumer_config.DeathQueue.QueueName != "" {
 		err := MQServer.CreateDeathQueue(RabbitMQConf, consumer_config.VHost, map[string]interface{}{
 			"x_death_queue_name":        consumer_config.DeathQueue.QueueName,
@@ -116,6 +182,12 @@ func start_consumer(consumer_config models.ConsumerParams) {
 	if consumer_config.QueueCount == 0 {
 		consumer_config.QueueCount = 1
 	}
+	// Partitioned consumers keep one set of lanes per consumer id, so they
+	// only run one channel.
+	if utils.PartitionEnabled(consumer_config.Partition) && consumer_config.QueueCount > 1 {
+		logger.E(FUNCNAME, fmt.Sprintf("partition cannot be used with queue_count above 1, start one channel. id:%s, queue_count:%d", consumer_config.Id, consumer_config.QueueCount))
+		consumer_config.QueueCount = 1
+	}
 
 	for i := 0; i < int(consumer_config.QueueCount); i++ {
 		err := mq_server.StartConsumer(&consumer_config)
@@ -140,12 +212,12 @@ func handleConsumerNotifications() {
 			logger.I("main", fmt.Sprintf("update consumer. id:%s", notification.Consumer.Id))
 			ConsumersMutex.Lock()
 
+			// Stop the running consumer, it keeps its own copy of the old settings
 			if client, exists := ConsumersPool[notification.Consumer.Id]; exists {
-				if notification.Consumer.Status == "stopped" {
-					client.StopConsumer()
-					delete(ConsumersPool, notification.Consumer.Id)
-				}
+				client.StopConsumer()
+				delete(ConsumersPool, notification.Consumer.Id)
 			}
+			delete(WindowedConsumers, notification.Consumer.Id)
 
 			if notification.Consumer.Status == "running" {
 				start_consumer(notification.Consumer)
@@ -163,6 +235,7 @@ func handleConsumerNotifications() {
 				client.StopConsumer()
 				delete(ConsumersPool, notification.Consumer.Id)
 			}
+			delete(WindowedConsumers, notification.Consumer.Id)
 			ConsumersMutex.Unlock()
 		case "restarted":
 			logger.I("main", fmt.Sprintf("restarting consumer. id:%s", notification.Consumer.Id))
@@ -171,12 +244,71 @@ func handleConsumerNotifications() {
 				client.StopConsumer()
 				delete(ConsumersPool, notification.Consumer.Id)
 			}
+			delete(WindowedConsumers, notification.Consumer.Id)
 			start_consumer(notification.Consumer)
 			ConsumersMutex.Unlock()
 		}
 	}
 }
 
+// watchActiveWindows starts and stops the windowed consumers at the
+// boundaries of their active windows. A stopped consumer leaves its messages
+// in the queue and keeps its configured status.
+func watchActiveWindows() {
+	const FUNCNAME = "watchActiveWindows"
+
+	for {
+		now := time.Now()
+		wait := WindowCheckInterval
+
+		ConsumersMutex.Lock()
+		for id, consumer := range WindowedConsumers {
+			active, next, err := utils.ActiveWindowState(consumer.ActiveWindows, now)
+			if err != nil {
+				continue
+			}
+			if !next.IsZero() && next.Sub(now) < wait {
+				wait = next.Sub(now)
+			}
+
+			client, running := ConsumersPool[id]
+			switch {
+			case active && !running:
+				logger.I(FUNCNAME, fmt.Sprintf("active window opened, start consumer. id:%s, until:%s", id, next.Format(time.RFC3339)))
+				start_consumer(consumer)
+			case !active && running:
+				logger.I(FUNCNAME, fmt.Sprintf("active window closed, stop consumer. id:%s, next:%s", id, next.Format(time.RFC3339)))
+				client.StopConsumer()
+				delete(ConsumersPool, id)
+			}
+		}
+		ConsumersMutex.Unlock()
+
+		// Wake up just past the next boundary.
+		time.Sleep(wait + time.Second)
+	}
+}
+
+// cleanupDedupeKeys removes the dedupe keys whose window has ended, and the
+// delivery counts of messages that were never settled.
+func cleanupDedupeKeys() {
+	const FUNCNAME = "cleanupDedupeKeys"
+
+	for {
+		if n, err := db.DeleteExpiredDedupeKeys(db.DB, time.Now()); err != nil {
+			logger.E(FUNCNAME, "failed to delete expired dedupe keys.", err.Error())
+		} else if n > 0 {
+			logger.I(FUNCNAME, fmt.Sprintf("deleted %d expired dedupe keys", n))
+		}
+		if n, err := MQServer.CleanupDeliveryAttempts(); err != nil {
+			logger.E(FUNCNAME, "failed to delete stale delivery attempts.", err.Error())
+		} else if n > 0 {
+			logger.I(FUNCNAME, fmt.Sprintf("deleted %d stale delivery attempts", n))
+		}
+		time.Sleep(DedupeCleanupInterval)
+	}
+}
+
 func main() {
 	init_config()
 
@@ -191,16 +323,24 @@ func main() {
 	}
 	defer database.Close()
 
+	// Resume pending retry jobs and start the retry workers
+	scheduler.Start(RetryWorkers)
+	go cleanupDedupeKeys()
+
 	// Set the ConsumerNotificationChan
 	api.SetConsumerNotificationChan(ConsumerNotificationChan)
+	api.SetAdminToken(os.Getenv(AdminTokenEnv))
 
 	// Register API routes
 	api.RegisterRoutes(app, database)
 
 	go func() {
+		ConsumersMutex.Lock()
 		for _, consumer := range ConsumersConf.Consumers {
 			start_consumer(consumer)
 		}
+		ConsumersMutex.Unlock()
+		watchActiveWindows()
 	}()
 
 	go handleConsumerNotifications()
@@ -0,0 +1,199 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-rabbitmq-consumers/db"
+	"go-rabbitmq-consumers/logger"
+	"go-rabbitmq-consumers/models"
+	"go-rabbitmq-consumers/utils"
+	"time"
+)
+
+// pollInterval is how often the scheduler looks for due retry jobs.
+const pollInterval = time.Second
+
+// stoppedConsumerDelay is how long the jobs of a stopped, rate limited
+// consumer wait before they are looked at again.
+const stoppedConsumerDelay = time.Minute
+
+var jobs chan models.RetryJob
+
+// Start resumes the retry jobs left by a previous run and starts a pool of
+// workers that run due jobs. It must be called once, after db.InitDB.
+func Start(workers int) {
+	const FUNCNAME = "scheduler.Start"
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	if n, err := db.ResetRunningRetryJobs(db.DB); err != nil {
+		logger.E(FUNCNAME, "failed to reset running retry jobs.", err.Error())
+	} else if n > 0 {
+		logger.I(FUNCNAME, fmt.Sprintf("resumed %d interrupted retry jobs", n))
+	}
+
+	jobs = make(chan models.RetryJob, workers)
+	for i := 0; i < workers; i++ {
+		go worker()
+	}
+	go poll(workers)
+}
+
+// Enqueue stores a failed callback as a durable retry job scheduled by the
+// consumer's retry policy. When the policy allows no retry at all, the request
+// goes straight to the failed store.
+func Enqueue(consumer *models.ConsumerParams, failed models.FailedCallback) error {
+	delay, ok := utils.RetryDelay(consumer.RetryPolicy, 1, 0)
+	if !ok {
+		return db.SaveFailedRequest(failed)
+	}
+	return Schedule(consumer, failed, 1, time.Now(), delay)
+}
+
+// Schedule stores a failed callback as a durable retry job that runs after
+// delay. attempt is how many times the request already failed, firstFailedAt
+// when it failed first; both count against the consumer's retry policy.
+func Schedule(consumer *models.ConsumerParams, failed models.FailedCallback, attempt int, firstFailedAt time.Time, delay time.Duration) error {
+	job := models.RetryJob{
+		ConsumerId:      consumer.Id,
+		QueueName:       consumer.QueueName,
+		RequestURL:      failed.RequestURL,
+		RequestData:     failed.RequestData,
+		Attempt:         attempt - 1,
+		FirstFailedAt:   firstFailedAt.UnixMilli(),
+		NextRunAt:       time.Now().Add(delay).UnixMilli(),
+		ResponseCode:    failed.ResponseCode,
+		ResponseContent: failed.ResponseContent,
+		Metadata:        failed.Metadata,
+	}
+
+	_, err := db.InsertRetryJob(db.DB, &job)
+	return err
+}
+
+func poll(limit int) {
+	const FUNCNAME = "scheduler.poll"
+
+	for {
+		due, err := db.ClaimDueRetryJobs(db.DB, time.Now().UnixMilli(), limit)
+		if err != nil {
+			logger.E(FUNCNAME, "failed to claim due retry jobs.", err.Error())
+		}
+		for _, job := range due {
+			jobs <- job
+		}
+		if len(due) < limit {
+			time.Sleep(pollInterval)
+		}
+	}
+}
+
+func worker() {
+	for job := range jobs {
+		run(job)
+	}
+}
+
+// run makes one attempt of a retry job and then deletes, reschedules or parks
+// it in the failed store.
+func run(job models.RetryJob) {
+	const FUNCNAME = "scheduler.run"
+
+	// Use the consumer's current settings, so edits apply to queued jobs too.
+	// Jobs of deleted consumers are dropped; jobs stored without a consumer
+	// fall back to the defaults.
+	consumer := &models.ConsumerParams{Id: job.ConsumerId, QueueName: job.QueueName}
+	if job.ConsumerId != "" {
+		c, err := db.FetchConsumer(db.DB, job.ConsumerId)
+		switch {
+		case err == sql.ErrNoRows:
+			logger.I(FUNCNAME, fmt.Sprintf("consumer deleted, drop retry job. job:%d, consumer_id:%s", job.Id, job.ConsumerId))
+			if err := db.DeleteRetryJob(db.DB, job.Id); err != nil {
+				logger.E(FUNCNAME, "failed to delete retry job.", err.Error())
+			}
+			return
+		case err != nil:
+			logger.E(FUNCNAME, "failed to fetch consumer, reschedule retry job.", err.Error())
+			job.NextRunAt = time.Now().Add(time.Minute).UnixMilli()
+			if err = db.RescheduleRetryJob(db.DB, &job); err != nil {
+				logger.E(FUNCNAME, "failed to reschedule retry job.", err.Error())
+			}
+			return
+		}
+		consumer = c
+	}
+
+	// The limiter of a rate limited consumer only exists while it runs. Jobs
+	// of a stopped one wait for it to start again rather than run unthrottled.
+	if consumer.RateLimit.Rate > 0 && !utils.ConsumerRateLimited(consumer.Id) {
+		job.NextRunAt = time.Now().Add(stoppedConsumerDelay).UnixMilli()
+		if err := db.RescheduleRetryJob(db.DB, &job); err != nil {
+			logger.E(FUNCNAME, "failed to reschedule retry job.", err.Error())
+		}
+		return
+	}
+
+	// Batch callbacks expect an array, so a retried item is sent as a batch of one.
+	request_body, headers := utils.ApplyMetadata(consumer.MetadataMode, job.Metadata, job.RequestData)
+	batch := utils.BatchEnabled(consumer.Batch)
+	if batch {
+		request_body = utils.BatchBody([]string{request_body})
+	}
+	utils.WaitRateLimit(context.Background(), consumer.Id, job.RequestURL)
+	body, err, statusCode := utils.SendCallback(consumer, job.RequestURL, request_body, headers, job.Metadata)
+	if err != nil {
+		logger.E(FUNCNAME, fmt.Sprintf("callback failed. job:%d, error:%s", job.Id, err.Error()))
+	}
+	job.Attempt++
+	var result utils.RuleResult
+	if batch {
+		result = utils.EvaluateBatch(consumer.SuccessCriteria, statusCode, body, 1)[0]
+	} else {
+		result = utils.EvaluateResponse(consumer, utils.TargetCriteria(consumer, job.RequestURL), statusCode, body)
+	}
+	if result.Success {
+		logger.I(FUNCNAME, fmt.Sprintf("retry successful. job:%d, queue_name:%s, attempt:%d", job.Id, job.QueueName, job.Attempt))
+		if err := db.DeleteRetryJob(db.DB, job.Id); err != nil {
+			logger.E(FUNCNAME, "failed to delete retry job.", err.Error())
+		}
+		return
+	}
+
+	job.ResponseCode = statusCode
+	job.ResponseContent = body
+	elapsed := time.Since(time.UnixMilli(job.FirstFailedAt))
+	if delay, ok := utils.RetryDelay(consumer.RetryPolicy, job.Attempt+1, elapsed); ok && !result.Permanent {
+		job.NextRunAt = time.Now().Add(delay).UnixMilli()
+		logger.I(FUNCNAME, fmt.Sprintf("retry attempt failed. job:%d, queue_name:%s, attempt:%d, reason:%s, next in %s", job.Id, job.QueueName, job.Attempt, result.Reason, delay))
+		if err := db.RescheduleRetryJob(db.DB, &job); err != nil {
+			logger.E(FUNCNAME, "failed to reschedule retry job.", err.Error())
+		}
+		return
+	}
+
+	// All retries failed, or the failure is permanent: save to the failed store
+	logger.E(FUNCNAME, fmt.Sprintf("all retry attempts failed. job:%d, queue_name:%s", job.Id, job.QueueName))
+	if err := db.SaveFailedRequest(models.FailedCallback{
+		ConsumerId:      job.ConsumerId,
+		QueueName:       job.QueueName,
+		RequestURL:      job.RequestURL,
+		RequestData:     job.RequestData,
+		ResponseCode:    job.ResponseCode,
+		ResponseContent: job.ResponseContent,
+		Reason:          result.Reason,
+		Metadata:        job.Metadata,
+	}); err != nil {
+		logger.E(FUNCNAME, "failed to save failed request, keep retry job.", err.Error())
+		job.NextRunAt = time.Now().Add(time.Minute).UnixMilli()
+		if err = db.RescheduleRetryJob(db.DB, &job); err != nil {
+			logger.E(FUNCNAME, "failed to reschedule retry job.", err.Error())
+		}
+		return
+	}
+	if err := db.DeleteRetryJob(db.DB, job.Id); err != nil {
+		logger.E(FUNCNAME, "failed to delete retry job.", err.Error())
+	}
+}
@@ -0,0 +1,284 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Cached OAuth2 tokens are renewed a little before they expire: a tenth of
+// their lifetime early, but never more than tokenExpiryMargin.
+const (
+	tokenExpiryFraction = 0.1
+	tokenExpiryMargin   = 30 * time.Second
+)
+
+type oauthToken struct {
+	accessToken string
+	expiresAt   time.Time
+}
+
+// tokenEntry holds the token of one cache key. Its mutex makes concurrent
+// callbacks wait for a single token request per key, without blocking the
+// other keys.
+type tokenEntry struct {
+	mu    sync.Mutex
+	token oauthToken
+}
+
+var (
+	tokenCache = map[string]*tokenEntry{}
+	tokenMutex sync.Mutex
+)
+
+// REDACTED stands in for a secret in API responses. Sent back unchanged in
+// an update, it keeps the stored secret.
+const REDACTED = "[redacted]"
+
+// redact hides a secret, leaving empty values empty so clients still see
+// which fields are set.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return REDACTED
+}
+
+// RedactURL hides the password in the userinfo of a URL, such as the
+// credentials of an amqp:// sink, for API responses and logs.
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); !ok {
+		return raw
+	}
+	u.User = url.UserPassword(u.User.Username(), REDACTED)
+	return u.String()
+}
+
+// RestoreURL puts back the password of a stored URL that an update sent
+// redacted and otherwise unchanged.
+func RestoreURL(raw string, stored ...string) string {
+	for _, s := range stored {
+		if s != raw && RedactURL(s) == raw {
+			return s
+		}
+	}
+	return raw
+}
+
+// ValidateCallbackAuth checks that an authentication scheme has the fields it needs.
+func ValidateCallbackAuth(auth models.CallbackAuth) error {
+	for name, value := range map[string]string{
+		"token":         auth.Token,
+		"password":      auth.Password,
+		"client_secret": auth.ClientSecret,
+	} {
+		if value == REDACTED {
+			return fmt.Errorf("%s must be sent in full, not as %s", name, REDACTED)
+		}
+	}
+
+	switch auth.Type {
+	case models.AUTH_NONE:
+	case models.AUTH_BEARER:
+		if auth.Token == "" {
+			return fmt.Errorf("bearer auth needs a token")
+		}
+	case models.AUTH_BASIC:
+		if auth.Username == "" {
+			return fmt.Errorf("basic auth needs a username")
+		}
+	case models.AUTH_OAUTH2:
+		if auth.TokenURL == "" || auth.ClientID == "" {
+			return fmt.Errorf("oauth2 auth needs token_url and client_id")
+		}
+	default:
+		return fmt.Errorf("unknown auth type: %s", auth.Type)
+	}
+
+	return nil
+}
+
+// RedactCallbackAuth hides the secrets of a scheme for API responses.
+func RedactCallbackAuth(auth models.CallbackAuth) models.CallbackAuth {
+	auth.Token = redact(auth.Token)
+	auth.Password = redact(auth.Password)
+	auth.ClientSecret = redact(auth.ClientSecret)
+	return auth
+}
+
+// RestoreCallbackAuth returns the callback auth of an updated consumer with
+// the stored secrets put back that the update sent as REDACTED. A token or
+// password is only kept while the callbacks stay on the stored origins, and
+// the client secret only for the same token_url, so an edit cannot send them
+// to another server.
+func RestoreCallbackAuth(consumer, stored *models.ConsumerParams) (models.CallbackAuth, error) {
+	auth := consumer.CallbackAuth
+	if auth.Token == REDACTED || auth.Password == REDACTED {
+		origins := callbackOrigins(stored)
+		for origin := range callbackOrigins(consumer) {
+			if !origins[origin] {
+				return auth, fmt.Errorf("token and password must be sent again when the callback moves to %s", origin)
+			}
+		}
+	}
+	if auth.Token == REDACTED {
+		auth.Token = stored.CallbackAuth.Token
+	}
+	if auth.Password == REDACTED {
+		auth.Password = stored.CallbackAuth.Password
+	}
+	if auth.ClientSecret == REDACTED {
+		if auth.TokenURL != stored.CallbackAuth.TokenURL {
+			return auth, fmt.Errorf("client_secret must be sent again when token_url changes")
+		}
+		auth.ClientSecret = stored.CallbackAuth.ClientSecret
+	}
+	return auth, nil
+}
+
+// callbackOrigins returns the scheme and host of every callback a consumer
+// sends to.
+func callbackOrigins(consumer *models.ConsumerParams) map[string]bool {
+	urls := []string{}
+	for _, target := range CallbackTargets(consumer) {
+		urls = append(urls, target.URL)
+	}
+	for _, rule := range consumer.RoutingRules {
+		urls = append(urls, rule.Callback)
+	}
+
+	origins := map[string]bool{}
+	for _, raw := range urls {
+		if u, err := url.Parse(raw); err == nil {
+			origins[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+		} else {
+			origins[raw] = true
+		}
+	}
+	return origins
+}
+
+// AuthorizationHeader returns the Authorization header value for the
+// consumer's scheme, or an empty string when the callback is not
+// authenticated.
+func AuthorizationHeader(consumer *models.ConsumerParams) (string, error) {
+	auth := consumer.CallbackAuth
+	switch auth.Type {
+	case models.AUTH_BEARER:
+		return "Bearer " + auth.Token, nil
+	case models.AUTH_BASIC:
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth.Username+":"+auth.Password)), nil
+	case models.AUTH_OAUTH2:
+		token, err := oauth2Token(consumer)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	}
+
+	return "", nil
+}
+
+func tokenCacheKey(auth models.CallbackAuth) string {
+	return auth.TokenURL + "|" + auth.ClientID + "|" + strings.Join(auth.Scopes, " ")
+}
+
+// cachedToken returns the cache entry of a key, adding an empty one when
+// there is none yet.
+func cachedToken(key string) *tokenEntry {
+	tokenMutex.Lock()
+	defer tokenMutex.Unlock()
+
+	entry, ok := tokenCache[key]
+	if !ok {
+		entry = &tokenEntry{}
+		tokenCache[key] = entry
+	}
+	return entry
+}
+
+// InvalidateOAuth2Token drops the cached token of a scheme, e.g. after the
+// callback answered 401.
+func InvalidateOAuth2Token(auth models.CallbackAuth) {
+	entry := cachedToken(tokenCacheKey(auth))
+	entry.mu.Lock()
+	entry.token = oauthToken{}
+	entry.mu.Unlock()
+}
+
+// tokenExpiresAt returns when a token issued now with a lifetime of
+// expiresIn seconds should be renewed.
+func tokenExpiresAt(now time.Time, expiresIn int64) time.Time {
+	if expiresIn <= 0 {
+		return now.Add(time.Hour)
+	}
+	lifetime := time.Duration(expiresIn) * time.Second
+	margin := time.Duration(float64(lifetime) * tokenExpiryFraction)
+	if margin > tokenExpiryMargin {
+		margin = tokenExpiryMargin
+	}
+	return now.Add(lifetime - margin)
+}
+
+// oauth2Token returns a cached client-credentials token, fetching a new one
+// with the consumer's HTTP client when none is cached or the cached one is
+// about to expire.
+func oauth2Token(consumer *models.ConsumerParams) (string, error) {
+	auth := consumer.CallbackAuth
+	entry := cachedToken(tokenCacheKey(auth))
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.token.accessToken != "" && time.Now().Before(entry.token.expiresAt) {
+		return entry.token.accessToken, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", auth.ClientID)
+	form.Set("client_secret", auth.ClientSecret)
+	if len(auth.Scopes) > 0 {
+		form.Set("scope", strings.Join(auth.Scopes, " "))
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod("POST")
+	req.Header.SetContentType("application/x-www-form-urlencoded")
+	req.SetRequestURI(auth.TokenURL)
+	req.SetBodyString(form.Encode())
+
+	if err := ConsumerHttpClient(consumer).client.Do(req, resp); err != nil {
+		return "", fmt.Errorf("oauth2 token request failed: %s", err.Error())
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return "", fmt.Errorf("oauth2 token request failed: http status code %d", resp.StatusCode())
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil || result.AccessToken == "" {
+		return "", fmt.Errorf("oauth2 token response has no access_token")
+	}
+
+	entry.token = oauthToken{accessToken: result.AccessToken, expiresAt: tokenExpiresAt(time.Now(), result.ExpiresIn)}
+
+	return entry.token.accessToken, nil
+}
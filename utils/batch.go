@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-rabbitmq-consumers/models"
+)
+
+const (
+	// MAX_BATCH_SIZE bounds the number of messages held for one callback.
+	MAX_BATCH_SIZE = 10000
+	// DEFAULT_BATCH_TIMEOUT is the batch wait in milliseconds when none is set.
+	DEFAULT_BATCH_TIMEOUT = 1000
+)
+
+// batchResponse is the optional part of a batch callback response that lists
+// the positions of the items the callback could not process.
+type batchResponse struct {
+	Failed []int `json:"failed"`
+}
+
+// BatchEnabled reports whether the consumer groups messages into batches.
+func BatchEnabled(batch models.BatchSettings) bool {
+	return batch.Size > 1
+}
+
+// ValidateBatchSettings checks the batch size and timeout.
+func ValidateBatchSettings(batch models.BatchSettings) error {
+	if batch.Size < 0 || batch.Size > MAX_BATCH_SIZE {
+		return fmt.Errorf("size must be between 0 and %d", MAX_BATCH_SIZE)
+	}
+	if batch.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	return nil
+}
+
+// BatchBody renders the items of a batch as a JSON array. JSON items are
+// embedded as is, anything else as a string.
+func BatchBody(items []string) string {
+	payload := make([]interface{}, len(items))
+	for i, item := range items {
+		if json.Valid([]byte(item)) {
+			payload[i] = json.RawMessage(item)
+		} else {
+			payload[i] = item
+		}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "[]"
+	}
+	return string(data)
+}
+
+// EvaluateBatch evaluates the response to a batch of size items and returns
+// one result per item. When the callback as a whole fails every item fails
+// with it. Otherwise the positions listed in the "failed" array of the
+// response body fail and the rest succeed.
+func EvaluateBatch(criteria models.SuccessCriteria, statusCode int, responseBody string, size int) []RuleResult {
+	results := make([]RuleResult, size)
+
+	result := EvaluateCallback(criteria, statusCode, responseBody)
+	for i := range results {
+		results[i] = result
+	}
+	if !result.Success {
+		return results
+	}
+
+	var response batchResponse
+	if err := json.Unmarshal([]byte(responseBody), &response); err != nil {
+		return results
+	}
+	for _, i := range response.Failed {
+		if i >= 0 && i < size {
+			results[i] = RuleResult{Rule: RULE_BATCH_ITEM, Reason: fmt.Sprintf("item %d reported failed by callback", i)}
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,289 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"go-rabbitmq-consumers/logger"
+	"go-rabbitmq-consumers/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half_open"
+)
+
+const (
+	// DEFAULT_BREAKER_OPEN_TIMEOUT is how long a breaker stays open when the
+	// consumer does not set open_timeout.
+	DEFAULT_BREAKER_OPEN_TIMEOUT = 30 * time.Second
+	// DEFAULT_BREAKER_PROBES is the number of successful probes that close a
+	// half-open breaker when the consumer does not set probe_count.
+	DEFAULT_BREAKER_PROBES = 1
+)
+
+// Breaker is the circuit breaker of one callback URL. It opens after
+// FailureThreshold consecutive failed callbacks, lets probe requests through
+// once OpenTimeout has passed, and closes again after ProbeCount of them
+// succeeded in a row. A nil Breaker always allows requests.
+type Breaker struct {
+	mu        sync.Mutex
+	url       string
+	threshold int
+	timeout   time.Duration
+	probes    int
+
+	state    string
+	failures int
+	openedAt time.Time
+	inflight int // probes in flight while half-open
+	passed   int // successful probes while half-open
+	changed  chan struct{}
+}
+
+var (
+	breakersMutex sync.RWMutex
+	breakers      = map[string]*Breaker{}
+)
+
+// ValidateCircuitBreaker checks the thresholds and open timeout of a breaker.
+func ValidateCircuitBreaker(settings models.CircuitBreaker) error {
+	if settings.FailureThreshold < 0 {
+		return fmt.Errorf("failure_threshold must not be negative")
+	}
+	if settings.ProbeCount < 0 {
+		return fmt.Errorf("probe_count must not be negative")
+	}
+	if settings.OpenTimeout != "" {
+		if d, err := time.ParseDuration(settings.OpenTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid open_timeout: %s", settings.OpenTimeout)
+		}
+	}
+	return nil
+}
+
+// SetCallbackBreaker applies a consumer's breaker settings to the breaker of
+// its callback URL, creating it when needed. Consumers sharing a URL share its
+// breaker; the settings applied last win.
+func SetCallbackBreaker(url string, settings models.CircuitBreaker) {
+	if settings.FailureThreshold <= 0 {
+		return
+	}
+
+	timeout := DEFAULT_BREAKER_OPEN_TIMEOUT
+	if d, err := time.ParseDuration(settings.OpenTimeout); err == nil && d > 0 {
+		timeout = d
+	}
+	probes := settings.ProbeCount
+	if probes < 1 {
+		probes = DEFAULT_BREAKER_PROBES
+	}
+
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	b, ok := breakers[url]
+	if !ok {
+		b = &Breaker{url: url, state: BREAKER_CLOSED, changed: make(chan struct{})}
+		breakers[url] = b
+	}
+	b.mu.Lock()
+	b.threshold, b.timeout, b.probes = settings.FailureThreshold, timeout, probes
+	b.mu.Unlock()
+}
+
+// CallbackBreaker returns the breaker a consumer's callbacks go through, or
+// nil when the consumer has no breaker.
+func CallbackBreaker(consumer *models.ConsumerParams) *Breaker {
+	if consumer.CircuitBreaker.FailureThreshold <= 0 {
+		return nil
+	}
+
+	breakersMutex.RLock()
+	defer breakersMutex.RUnlock()
+	return breakers[consumer.Callback]
+}
+
+// BreakerStates reports the state of every callback breaker, ordered by URL.
+func BreakerStates() []models.BreakerState {
+	breakersMutex.RLock()
+	states := make([]models.BreakerState, 0, len(breakers))
+	for _, b := range breakers {
+		states = append(states, b.State())
+	}
+	breakersMutex.RUnlock()
+
+	sort.Slice(states, func(i, j int) bool { return states[i].URL < states[j].URL })
+	return states
+}
+
+// setState moves the breaker to state and wakes up everyone waiting on it.
+// The caller holds b.mu.
+func (b *Breaker) setState(state string, reason string) {
+	if b.state != state {
+		logger.I("CircuitBreaker", fmt.Sprintf("url:%s, %s -> %s, %s", RedactURL(b.url), b.state, state, reason))
+	}
+	b.state = state
+	b.inflight, b.passed = 0, 0
+	if state == BREAKER_OPEN {
+		b.openedAt = time.Now()
+	}
+	if state == BREAKER_CLOSED {
+		b.failures = 0
+	}
+	b.notify()
+}
+
+// notify wakes up everyone waiting on a change. The caller holds b.mu.
+func (b *Breaker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// halfOpenDue moves an open breaker to half-open once its open timeout has
+// passed. The caller holds b.mu.
+func (b *Breaker) halfOpenDue() {
+	if b.state == BREAKER_OPEN && time.Since(b.openedAt) >= b.timeout {
+		b.setState(BREAKER_HALF_OPEN, "probing")
+	}
+}
+
+// Acquire reports whether a callback may be sent. A closed breaker allows it
+// and an open one refuses it. A half-open breaker allows up to ProbeCount
+// probes at a time; further callers wait until the probes decide the state,
+// or until ctx is done.
+func (b *Breaker) Acquire(ctx context.Context) bool {
+	if b == nil {
+		return true
+	}
+
+	for {
+		b.mu.Lock()
+		b.halfOpenDue()
+		switch {
+		case b.state == BREAKER_CLOSED:
+			b.mu.Unlock()
+			return true
+		case b.state == BREAKER_OPEN:
+			b.mu.Unlock()
+			return false
+		case b.inflight+b.passed < b.probes:
+			b.inflight++
+			b.mu.Unlock()
+			return true
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Record counts the outcome of a callback allowed by Acquire.
+func (b *Breaker) Record(success bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BREAKER_CLOSED:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.setState(BREAKER_OPEN, fmt.Sprintf("%d consecutive failures", b.failures))
+		}
+	case BREAKER_HALF_OPEN:
+		if !success {
+			b.failures++
+			b.setState(BREAKER_OPEN, "probe failed")
+			return
+		}
+		if b.inflight > 0 {
+			b.inflight--
+		}
+		b.passed++
+		if b.passed >= b.probes {
+			b.setState(BREAKER_CLOSED, fmt.Sprintf("%d probes succeeded", b.passed))
+			return
+		}
+		b.notify()
+	}
+}
+
+// IsOpen reports whether the breaker refuses callbacks right now.
+func (b *Breaker) IsOpen() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.halfOpenDue()
+	return b.state == BREAKER_OPEN
+}
+
+// WaitHalfOpen blocks while the breaker is open. It returns false when ctx is
+// done first.
+func (b *Breaker) WaitHalfOpen(ctx context.Context) bool {
+	if b == nil {
+		return true
+	}
+
+	for {
+		b.mu.Lock()
+		b.halfOpenDue()
+		if b.state != BREAKER_OPEN {
+			b.mu.Unlock()
+			return true
+		}
+		wait := b.timeout - time.Since(b.openedAt)
+		changed := b.changed
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// State reports the current breaker state.
+func (b *Breaker) State() models.BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.halfOpenDue()
+
+	state := models.BreakerState{
+		URL:              b.url,
+		State:            b.state,
+		Failures:         b.failures,
+		FailureThreshold: b.threshold,
+		OpenTimeout:      b.timeout.String(),
+		ProbesPassed:     b.passed,
+		ProbeCount:       b.probes,
+	}
+	if !b.openedAt.IsZero() {
+		openedAt := b.openedAt
+		state.OpenedAt = &openedAt
+	}
+	return state
+}
@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RuleResult explains the outcome of evaluating a callback response against
+// the success criteria of a consumer.
+// A Permanent failure is not worth retrying.
+type RuleResult struct {
+	Success   bool   `json:"success"`
+	Permanent bool   `json:"permanent,omitempty"`
+	Rule      string `json:"rule"`
+	Reason    string `json:"reason"`
+}
+
+// Names of the success rules reported in RuleResult.Rule.
+const (
+	RULE_STATUS_CODE = "status_code"
+	RULE_ERROR_CODE  = "error_code_envelope"
+	RULE_JSON_PATH   = "json_path"
+	RULE_TRANSPORT   = "transport"
+	RULE_BATCH_ITEM  = "batch_item"
+	RULE_GRPC_STATUS = "grpc_status"
+	RULE_SINK        = "sink"
+	RULE_TRANSFORM   = "transform"
+)
+
+// ValidateSuccessCriteria checks that the status codes and JSON path of the
+// criteria can be evaluated.
+func ValidateSuccessCriteria(criteria models.SuccessCriteria) error {
+	for _, code := range criteria.StatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid status code: %d", code)
+		}
+	}
+	if criteria.JSONPath != "" {
+		for _, part := range strings.Split(criteria.JSONPath, ".") {
+			if part == "" {
+				return fmt.Errorf("invalid json_path: %q", criteria.JSONPath)
+			}
+		}
+	}
+
+	return nil
+}
+
+// EvaluateCallback applies the success criteria to a callback response. A
+// status code of 0 means the request never got a response.
+func EvaluateCallback(criteria models.SuccessCriteria, statusCode int, responseBody string) RuleResult {
+	if statusCode == 0 {
+		return RuleResult{Rule: RULE_TRANSPORT, Reason: "no response from callback"}
+	}
+
+	codes := criteria.StatusCodes
+	if len(codes) == 0 {
+		codes = []int{200}
+	}
+	accepted := false
+	for _, code := range codes {
+		if code == statusCode {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		return RuleResult{Rule: RULE_STATUS_CODE, Reason: fmt.Sprintf("status code %d not in %v", statusCode, codes)}
+	}
+	if criteria.StatusCodeOnly {
+		return RuleResult{Success: true, Rule: RULE_STATUS_CODE, Reason: fmt.Sprintf("status code %d accepted", statusCode)}
+	}
+
+	if criteria.JSONPath == "" {
+		var cb_data models.CallbackData
+		if err := json.Unmarshal([]byte(responseBody), &cb_data); err != nil {
+			return RuleResult{Rule: RULE_ERROR_CODE, Reason: "invalid response body: " + err.Error()}
+		}
+		if cb_data.ErrorCode != 0 {
+			return RuleResult{Rule: RULE_ERROR_CODE, Reason: fmt.Sprintf("error_code %d: %s", cb_data.ErrorCode, cb_data.ErrorMsg)}
+		}
+		return RuleResult{Success: true, Rule: RULE_ERROR_CODE, Reason: "error_code is 0"}
+	}
+
+	value, err := JSONPathValue(responseBody, criteria.JSONPath)
+	if err != nil {
+		return RuleResult{Rule: RULE_JSON_PATH, Reason: err.Error()}
+	}
+	if value != criteria.ExpectedValue {
+		return RuleResult{Rule: RULE_JSON_PATH, Reason: fmt.Sprintf("%s is %q, expected %q", criteria.JSONPath, value, criteria.ExpectedValue)}
+	}
+	return RuleResult{Success: true, Rule: RULE_JSON_PATH, Reason: fmt.Sprintf("%s is %q", criteria.JSONPath, value)}
+}
+
+// JSONPathValue returns the value at a dotted path in a JSON document as text.
+// Numeric path parts index arrays. Strings are returned without quotes, other
+// values as their JSON encoding.
+func JSONPathValue(document, path string) (string, error) {
+	var value interface{}
+
+	decoder := json.NewDecoder(strings.NewReader(document))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("invalid JSON: %s", err.Error())
+	}
+
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[part]
+			if !ok {
+				return "", fmt.Errorf("%s not found", path)
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", fmt.Errorf("%s not found", path)
+			}
+			value = v[i]
+		default:
+			return "", fmt.Errorf("%s not found", path)
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// callbackHeaders merges the consumer's static headers, authentication and
+// signature with the headers of one request, which win over the consumer's.
+func callbackHeaders(consumer *models.ConsumerParams, body string, headers map[string]string) (map[string]string, error) {
+	requestHeaders := map[string]string{}
+	for k, v := range consumer.CallbackHeaders {
+		requestHeaders[k] = v
+	}
+	authorization, err := AuthorizationHeader(consumer)
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		requestHeaders["Authorization"] = authorization
+	}
+	for k, v := range headers {
+		requestHeaders[k] = v
+	}
+	for k, v := range SignatureHeaders(consumer.CallbackSigning, body, time.Now()) {
+		requestHeaders[k] = v
+	}
+	return requestHeaders, nil
+}
+
+// SendCallback sends body to a callback URL over the consumer's transport.
+func SendCallback(consumer *models.ConsumerParams, url, body string, headers map[string]string, metadata *models.MessageMetadata) (string, error, int) {
+	switch consumer.Transport {
+	case models.TRANSPORT_GRPC:
+		return GrpcRequest(consumer, url, body, headers, metadata)
+	case models.TRANSPORT_FILE, models.TRANSPORT_EXEC, models.TRANSPORT_AMQP:
+		return SinkRequest(consumer, url, body, headers, metadata)
+	}
+	return CallbackRequest(consumer, url, body, headers)
+}
+
+// EvaluateResponse judges a callback response by the consumer's transport:
+// gRPC status codes, sink exit codes, or HTTP responses against the success
+// criteria.
+func EvaluateResponse(consumer *models.ConsumerParams, criteria models.SuccessCriteria, statusCode int, responseBody string) RuleResult {
+	switch consumer.Transport {
+	case models.TRANSPORT_GRPC:
+		return EvaluateGrpcStatus(statusCode, responseBody)
+	case models.TRANSPORT_FILE, models.TRANSPORT_EXEC, models.TRANSPORT_AMQP:
+		return EvaluateSink(statusCode, responseBody)
+	}
+	return EvaluateCallback(criteria, statusCode, responseBody)
+}
+
+// CallbackRequest sends body to a consumer callback URL with the consumer's
+// method, static headers, authentication and signature. headers are added
+// after the consumer's own and win over them.
+func CallbackRequest(consumer *models.ConsumerParams, url, body string, headers map[string]string) (string, error, int) {
+	method, err := ParseHttpMethod(consumer.CallbackMethod)
+	if err != nil {
+		return "", err, 0
+	}
+
+	requestHeaders, err := callbackHeaders(consumer, body, headers)
+	if err != nil {
+		return "", err, 0
+	}
+
+	httpClient := ConsumerHttpClient(consumer)
+	responseBody, err, statusCode := httpClient.Request(method, requestHeaders, url, body)
+
+	// A rejected OAuth2 token may have been revoked early, fetch a new one once
+	if statusCode == 401 && consumer.CallbackAuth.Type == models.AUTH_OAUTH2 {
+		InvalidateOAuth2Token(consumer.CallbackAuth)
+		var authorization string
+		if authorization, err = AuthorizationHeader(consumer); err != nil {
+			return responseBody, err, statusCode
+		}
+		requestHeaders["Authorization"] = authorization
+		responseBody, err, statusCode = httpClient.Request(method, requestHeaders, url, body)
+	}
+
+	return responseBody, err, statusCode
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"go-rabbitmq-consumers/models"
+	"testing"
+)
+
+func TestEvaluateCallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		criteria models.SuccessCriteria
+		status   int
+		body     string
+		success  bool
+		rule     string
+	}{
+		{"default envelope", models.SuccessCriteria{}, 200, `{"error_code":0}`, true, RULE_ERROR_CODE},
+		{"default envelope error", models.SuccessCriteria{}, 200, `{"error_code":3}`, false, RULE_ERROR_CODE},
+		{"default status", models.SuccessCriteria{}, 201, `{"error_code":0}`, false, RULE_STATUS_CODE},
+		{"no response", models.SuccessCriteria{}, 0, ``, false, RULE_TRANSPORT},
+		{"status only", models.SuccessCriteria{StatusCodes: []int{201, 204}, StatusCodeOnly: true}, 204, ``, true, RULE_STATUS_CODE},
+		{"json path", models.SuccessCriteria{JSONPath: "data.items.1.ok", ExpectedValue: "true"}, 200, `{"data":{"items":[{},{"ok":true}]}}`, true, RULE_JSON_PATH},
+		{"json path mismatch", models.SuccessCriteria{JSONPath: "code", ExpectedValue: "ok"}, 200, `{"code":"fail"}`, false, RULE_JSON_PATH},
+		{"json path missing", models.SuccessCriteria{JSONPath: "code", ExpectedValue: "ok"}, 200, `{}`, false, RULE_JSON_PATH},
+	}
+
+	for _, tt := range tests {
+		result := EvaluateCallback(tt.criteria, tt.status, tt.body)
+		if result.Success != tt.success || result.Rule != tt.rule {
+			t.Errorf("%s: got %+v, want success=%v rule=%s", tt.name, result, tt.success, tt.rule)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"time"
+)
+
+// DEFAULT_DEDUPE_WINDOW is how long a dedupe key is remembered by default.
+const DEFAULT_DEDUPE_WINDOW = 24 * time.Hour
+
+// ValidateDedupe checks the key source and window of a dedupe setting.
+func ValidateDedupe(dedupe models.Dedupe) error {
+	switch dedupe.Source {
+	case "", models.DEDUPE_MESSAGE_ID:
+	case models.DEDUPE_HEADER:
+		if dedupe.Header == "" {
+			return fmt.Errorf("header is required")
+		}
+	case models.DEDUPE_JSON_PATH:
+		if err := ValidateSuccessCriteria(models.SuccessCriteria{JSONPath: dedupe.JSONPath}); err != nil || dedupe.JSONPath == "" {
+			return fmt.Errorf("invalid json_path: %q", dedupe.JSONPath)
+		}
+	default:
+		return fmt.Errorf("unknown source: %s", dedupe.Source)
+	}
+	if window, err := profileDuration(dedupe.Window, 0); err != nil {
+		return fmt.Errorf("window: %s", err.Error())
+	} else if dedupe.Window != "" && window == 0 {
+		return fmt.Errorf("window must be positive")
+	}
+	return nil
+}
+
+// DedupeWindow returns how long the keys of a dedupe setting are remembered.
+func DedupeWindow(dedupe models.Dedupe) time.Duration {
+	window, _ := profileDuration(dedupe.Window, DEFAULT_DEDUPE_WINDOW)
+	return window
+}
+
+// DedupeKey derives the dedupe key of a message. It returns false when
+// deduplication is off or the message has no key, which leaves it to be
+// delivered.
+func DedupeKey(dedupe models.Dedupe, metadata *models.MessageMetadata, body string) (string, bool) {
+	var key string
+	switch dedupe.Source {
+	case models.DEDUPE_MESSAGE_ID:
+		key = metadata.MessageId
+	case models.DEDUPE_HEADER:
+		if value, ok := metadata.Headers[dedupe.Header]; ok {
+			key = fmt.Sprint(value)
+		}
+	case models.DEDUPE_JSON_PATH:
+		key, _ = JSONPathValue(body, dedupe.JSONPath)
+	}
+	return key, key != ""
+}
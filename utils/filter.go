@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/PaesslerAG/gval"
+)
+
+// Filter expressions are gval expressions over a message, such as
+//
+//	body.amount > 1000 && headers["x-tenant"] == "acme"
+//
+// body is the decoded JSON body of the transformed message, or the body text
+// when it is not JSON; headers, routing_key, exchange and message_id come from
+// the message properties. The expression must evaluate to a bool.
+
+// filterStats is the running count of the messages a filter kept back.
+type filterStats struct {
+	filtered       int64
+	lastFilteredAt time.Time
+}
+
+var (
+	filtersMutex sync.RWMutex
+	filters      = map[string]gval.Evaluable{}
+	filterCounts = map[string]*filterStats{}
+)
+
+// compileFilter parses an expression once and keeps it for later messages.
+func compileFilter(expression string) (gval.Evaluable, error) {
+	filtersMutex.RLock()
+	eval, ok := filters[expression]
+	filtersMutex.RUnlock()
+	if ok {
+		return eval, nil
+	}
+
+	eval, err := gval.Full().NewEvaluable(expression)
+	if err != nil {
+		return nil, err
+	}
+	filtersMutex.Lock()
+	filters[expression] = eval
+	filtersMutex.Unlock()
+	return eval, nil
+}
+
+// ValidateFilter checks that a filter expression parses. An empty filter lets
+// every message through.
+func ValidateFilter(expression string) error {
+	if expression == "" {
+		return nil
+	}
+	_, err := gval.Full().NewEvaluable(expression)
+	return err
+}
+
+// filterParameters exposes a message to a filter expression.
+func filterParameters(metadata *models.MessageMetadata, body string) map[string]interface{} {
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(body), &decoded); err != nil {
+		decoded = body
+	}
+
+	parameters := map[string]interface{}{
+		"body":        decoded,
+		"headers":     map[string]interface{}{},
+		"routing_key": "",
+		"exchange":    "",
+		"message_id":  "",
+	}
+	if metadata != nil {
+		headers := make(map[string]interface{}, len(metadata.Headers))
+		for k, v := range metadata.Headers {
+			headers[k] = v
+		}
+		parameters["headers"] = headers
+		parameters["routing_key"] = metadata.RoutingKey
+		parameters["exchange"] = metadata.Exchange
+		parameters["message_id"] = metadata.MessageId
+	}
+	return parameters
+}
+
+// FilterMatches evaluates a consumer's filter expression against a message.
+// An empty filter matches every message.
+func FilterMatches(expression string, metadata *models.MessageMetadata, body string) (bool, error) {
+	if expression == "" {
+		return true, nil
+	}
+	eval, err := compileFilter(expression)
+	if err != nil {
+		return false, err
+	}
+	return evaluateFilter(eval, metadata, body)
+}
+
+// TestFilter evaluates an expression against a sample message without keeping
+// it for later messages.
+func TestFilter(expression string, metadata *models.MessageMetadata, body string) (bool, error) {
+	eval, err := gval.Full().NewEvaluable(expression)
+	if err != nil {
+		return false, err
+	}
+	return evaluateFilter(eval, metadata, body)
+}
+
+func evaluateFilter(eval gval.Evaluable, metadata *models.MessageMetadata, body string) (bool, error) {
+	value, err := eval(context.Background(), filterParameters(metadata, body))
+	if err != nil {
+		return false, err
+	}
+	matched, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("filter evaluated to %T, not bool", value)
+	}
+	return matched, nil
+}
+
+// CountFiltered counts a message the consumer's filter kept back.
+func CountFiltered(consumerID string) {
+	filtersMutex.Lock()
+	defer filtersMutex.Unlock()
+
+	stats, ok := filterCounts[consumerID]
+	if !ok {
+		stats = &filterStats{}
+		filterCounts[consumerID] = stats
+	}
+	stats.filtered++
+	stats.lastFilteredAt = time.Now()
+}
+
+// RemoveFilterStats forgets the counts of a deleted consumer.
+func RemoveFilterStats(consumerID string) {
+	filtersMutex.Lock()
+	defer filtersMutex.Unlock()
+	delete(filterCounts, consumerID)
+}
+
+// FilterStats reports the filtered message counts by consumer since startup.
+func FilterStats() []models.FilterStats {
+	filtersMutex.RLock()
+	defer filtersMutex.RUnlock()
+
+	stats := make([]models.FilterStats, 0, len(filterCounts))
+	for id, s := range filterCounts {
+		stats = append(stats, models.FilterStats{
+			ConsumerId:     id,
+			Filtered:       s.filtered,
+			LastFilteredAt: s.lastFilteredAt.UnixMilli(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ConsumerId < stats[j].ConsumerId })
+	return stats
+}
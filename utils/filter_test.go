@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"go-rabbitmq-consumers/models"
+	"testing"
+)
+
+func TestFilterMatches(t *testing.T) {
+	metadata := &models.MessageMetadata{
+		RoutingKey: "order.paid",
+		Headers:    map[string]interface{}{"x-tenant": "acme"},
+	}
+	body := `{"amount":1500,"items":[{"sku":"a-1"}]}`
+
+	tests := []struct {
+		expression string
+		matched    bool
+		fails      bool
+	}{
+		{``, true, false},
+		{`body.amount > 1000`, true, false},
+		{`body.amount > 2000`, false, false},
+		{`headers["x-tenant"] == "acme" && routing_key =~ "^order\\."`, true, false},
+		{`body.items[0].sku == "a-1"`, true, false},
+		{`body.customer.tier == "gold"`, false, true},
+		{`body.amount`, false, true},
+	}
+	for _, tt := range tests {
+		matched, err := FilterMatches(tt.expression, metadata, body)
+		if matched != tt.matched || (err != nil) != tt.fails {
+			t.Errorf("%s: got %v, %v", tt.expression, matched, err)
+		}
+	}
+
+	if err := ValidateFilter(`body.amount >`); err == nil {
+		t.Error("incomplete expression accepted")
+	}
+}
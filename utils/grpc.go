@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// DEFAULT_GRPC_TIMEOUT bounds a gRPC callback without a configured timeout.
+const DEFAULT_GRPC_TIMEOUT = 30 * time.Second
+
+var grpcMethodPattern = regexp.MustCompile(`^/[\w.]+/\w+$`)
+
+// The gRPC envelope messages, built from the same definition as
+// proto/callback.proto.
+var envelopeDescriptor, replyDescriptor = callbackDescriptors()
+
+// grpcConns holds the connections of each consumer by callback URL, so they
+// can be closed when the consumer stops.
+var (
+	grpcConnsMutex sync.Mutex
+	grpcConns      = map[string]map[string]*grpc.ClientConn{}
+)
+
+func callbackDescriptors() (protoreflect.MessageDescriptor, protoreflect.MessageDescriptor) {
+	field := func(name, jsonName string, number int32, kind descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(jsonName),
+			Number:   proto.Int32(number),
+			Type:     kind.Enum(),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+	}
+	headers := field("headers", "headers", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	headers.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	headers.TypeName = proto.String(".rch.v1.CallbackEnvelope.HeadersEntry")
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("callback.proto"),
+		Package: proto.String("rch.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("CallbackEnvelope"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("body", "body", 1, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+					headers,
+					field("routing_key", "routingKey", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("exchange", "exchange", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("message_id", "messageId", 5, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("correlation_id", "correlationId", 6, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("consumer_id", "consumerId", 7, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("queue_name", "queueName", 8, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				},
+				NestedType: []*descriptorpb.DescriptorProto{{
+					Name: proto.String("HeadersEntry"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						field("key", "key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+						field("value", "value", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					},
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				}},
+			},
+			{
+				Name: proto.String("CallbackReply"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("body", "body", 1, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+				},
+			},
+		},
+	}
+
+	fd, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		panic(err)
+	}
+	return fd.Messages().ByName("CallbackEnvelope"), fd.Messages().ByName("CallbackReply")
+}
+
+// validateGrpcSettings checks the method and timeout of the gRPC transport.
+func validateGrpcSettings(settings models.GrpcSettings) error {
+	if !grpcMethodPattern.MatchString(settings.Method) {
+		return fmt.Errorf("invalid grpc method: %q", settings.Method)
+	}
+	if _, err := profileDuration(settings.Timeout, 0); err != nil {
+		return fmt.Errorf("grpc timeout: %s", err.Error())
+	}
+	return nil
+}
+
+// grpcConn returns the consumer's connection to a gRPC callback URL.
+func grpcConn(consumerID, callback string) (*grpc.ClientConn, error) {
+	grpcConnsMutex.Lock()
+	defer grpcConnsMutex.Unlock()
+
+	if conn, ok := grpcConns[consumerID][callback]; ok {
+		return conn, nil
+	}
+
+	u, err := url.Parse(callback)
+	if err != nil {
+		return nil, err
+	}
+	creds := insecure.NewCredentials()
+	if u.Scheme == "grpcs" {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	conn, err := grpc.Dial(u.Host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	if grpcConns[consumerID] == nil {
+		grpcConns[consumerID] = map[string]*grpc.ClientConn{}
+	}
+	grpcConns[consumerID][callback] = conn
+	return conn, nil
+}
+
+// RemoveConsumerGrpcConns closes the gRPC connections of a consumer.
+func RemoveConsumerGrpcConns(consumerID string) {
+	grpcConnsMutex.Lock()
+	conns := grpcConns[consumerID]
+	delete(grpcConns, consumerID)
+	grpcConnsMutex.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// GrpcRequest calls the consumer's gRPC method with an envelope of the body,
+// headers and message properties. The headers are also sent as gRPC metadata.
+// It returns the reply body, or the status message of a failed call, and the
+// gRPC status code.
+func GrpcRequest(consumer *models.ConsumerParams, callback, body string, headers map[string]string, msg *models.MessageMetadata) (string, error, int) {
+	conn, err := grpcConn(consumer.Id, callback)
+	if err != nil {
+		return "", err, int(codes.Unavailable)
+	}
+	// A token that could not be fetched is our failure, not the callback's
+	// answer, and a later attempt may get one.
+	requestHeaders, err := callbackHeaders(consumer, body, headers)
+	if err != nil {
+		return "", err, int(codes.Unavailable)
+	}
+
+	timeout, _ := profileDuration(consumer.Grpc.Timeout, DEFAULT_GRPC_TIMEOUT)
+
+	call := func() (string, error, int) {
+		envelope := dynamicpb.NewMessage(envelopeDescriptor)
+		fields := envelopeDescriptor.Fields()
+		envelope.Set(fields.ByName("body"), protoreflect.ValueOfBytes([]byte(body)))
+		envelopeHeaders := envelope.Mutable(fields.ByName("headers")).Map()
+		for k, v := range requestHeaders {
+			envelopeHeaders.Set(protoreflect.ValueOfString(k).MapKey(), protoreflect.ValueOfString(v))
+		}
+		properties := map[string]string{"consumer_id": consumer.Id, "queue_name": consumer.QueueName}
+		if msg != nil {
+			properties["routing_key"] = msg.RoutingKey
+			properties["exchange"] = msg.Exchange
+			properties["message_id"] = msg.MessageId
+			properties["correlation_id"] = msg.CorrelationId
+		}
+		for name, value := range properties {
+			envelope.Set(fields.ByName(protoreflect.Name(name)), protoreflect.ValueOfString(value))
+		}
+
+		ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), metadata.New(requestHeaders)), timeout)
+		defer cancel()
+
+		reply := dynamicpb.NewMessage(replyDescriptor)
+		if err := conn.Invoke(ctx, consumer.Grpc.Method, envelope, reply); err != nil {
+			s := status.Convert(err)
+			return s.Message(), err, int(s.Code())
+		}
+		return string(reply.Get(replyDescriptor.Fields().ByName("body")).Bytes()), nil, int(codes.OK)
+	}
+
+	responseBody, err, code := call()
+
+	// A rejected OAuth2 token may have been revoked early, fetch a new one once
+	if code == int(codes.Unauthenticated) && consumer.CallbackAuth.Type == models.AUTH_OAUTH2 {
+		InvalidateOAuth2Token(consumer.CallbackAuth)
+		var authorization string
+		if authorization, err = AuthorizationHeader(consumer); err != nil {
+			return responseBody, err, code
+		}
+		requestHeaders["Authorization"] = authorization
+		responseBody, err, code = call()
+	}
+
+	return responseBody, err, code
+}
+
+// EvaluateGrpcStatus maps the status code of a gRPC callback to a result.
+// Codes that may clear up on their own are retried, the others are permanent
+// failures.
+func EvaluateGrpcStatus(code int, message string) RuleResult {
+	c := codes.Code(code)
+	switch c {
+	case codes.OK:
+		return RuleResult{Success: true, Rule: RULE_GRPC_STATUS, Reason: "status OK"}
+	case codes.Canceled, codes.Unknown, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal, codes.Unavailable:
+		return RuleResult{Rule: RULE_GRPC_STATUS, Reason: fmt.Sprintf("status %s: %s", c, message)}
+	}
+	return RuleResult{Permanent: true, Rule: RULE_GRPC_STATUS, Reason: fmt.Sprintf("status %s: %s", c, message)}
+}
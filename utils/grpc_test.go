@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"context"
+	"go-rabbitmq-consumers/models"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// grpcHandler answers one envelope of the in-process callback service.
+type grpcHandler func(envelope *dynamicpb.Message, md metadata.MD) (string, error)
+
+// startGrpcServer runs an in-process rch.v1.CallbackService on a local port
+// and returns its grpc:// URL.
+func startGrpcServer(t *testing.T, handler grpcHandler) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "rch.v1.CallbackService",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Deliver",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				envelope := dynamicpb.NewMessage(envelopeDescriptor)
+				if err := dec(envelope); err != nil {
+					return nil, err
+				}
+				md, _ := metadata.FromIncomingContext(ctx)
+				body, err := handler(envelope, md)
+				if err != nil {
+					return nil, err
+				}
+				reply := dynamicpb.NewMessage(replyDescriptor)
+				reply.Set(replyDescriptor.Fields().ByName("body"), protoreflect.ValueOfBytes([]byte(body)))
+				return reply, nil
+			},
+		}},
+	}, struct{}{})
+
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return "grpc://" + listener.Addr().String()
+}
+
+func envelopeString(envelope *dynamicpb.Message, name string) string {
+	return envelope.Get(envelopeDescriptor.Fields().ByName(protoreflect.Name(name))).String()
+}
+
+func TestGrpcRequest(t *testing.T) {
+	callback := startGrpcServer(t, func(envelope *dynamicpb.Message, md metadata.MD) (string, error) {
+		switch envelopeString(envelope, "routing_key") {
+		case "busy":
+			return "", status.Error(codes.Unavailable, "try later")
+		case "invalid":
+			return "", status.Error(codes.InvalidArgument, "bad order")
+		}
+		if token := md.Get("authorization"); len(token) != 1 || token[0] != "Bearer secret" {
+			return "", status.Error(codes.Unauthenticated, "no token")
+		}
+		headers := envelope.Get(envelopeDescriptor.Fields().ByName("headers")).Map()
+		tenant := headers.Get(protoreflect.ValueOfString("X-Tenant").MapKey()).String()
+		return tenant + ":" + string(envelope.Get(envelopeDescriptor.Fields().ByName("body")).Bytes()), nil
+	})
+
+	consumer := &models.ConsumerParams{
+		Id:           "1",
+		QueueName:    "orders",
+		Callback:     callback,
+		Transport:    models.TRANSPORT_GRPC,
+		Grpc:         models.GrpcSettings{Method: "/rch.v1.CallbackService/Deliver"},
+		CallbackAuth: models.CallbackAuth{Type: models.AUTH_BEARER, Token: "secret"},
+	}
+	if err := ValidateTransport(consumer); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		routingKey string
+		success    bool
+		permanent  bool
+		body       string
+	}{
+		{"order.paid", true, false, `acme:{"id":1}`},
+		{"busy", false, false, "try later"},
+		{"invalid", false, true, "bad order"},
+	}
+	for _, tt := range tests {
+		metadata := &models.MessageMetadata{RoutingKey: tt.routingKey}
+		body, _, code := SendCallback(consumer, callback, `{"id":1}`, map[string]string{"X-Tenant": "acme"}, metadata)
+		result := EvaluateResponse(consumer, consumer.SuccessCriteria, code, body)
+		if result.Success != tt.success || result.Permanent != tt.permanent || body != tt.body {
+			t.Errorf("%s: got %q %+v", tt.routingKey, body, result)
+		}
+	}
+
+	// Stopping the consumer closes its connections; a later call dials again.
+	RemoveConsumerGrpcConns(consumer.Id)
+	if _, ok := grpcConns[consumer.Id]; ok {
+		t.Fatal("connections kept after RemoveConsumerGrpcConns")
+	}
+	metadata := &models.MessageMetadata{RoutingKey: "order.paid"}
+	if body, err, _ := SendCallback(consumer, callback, `{"id":1}`, map[string]string{"X-Tenant": "acme"}, metadata); err != nil || body != `acme:{"id":1}` {
+		t.Fatalf("after reconnect got %q, %v", body, err)
+	}
+	RemoveConsumerGrpcConns(consumer.Id)
+
+	// A token that cannot be fetched fails the attempt, not the message.
+	consumer.CallbackAuth = models.CallbackAuth{Type: models.AUTH_OAUTH2, TokenURL: "http://127.0.0.1:1/token", ClientID: "client"}
+	body, err, code := SendCallback(consumer, callback, `{"id":1}`, nil, metadata)
+	if err == nil {
+		t.Fatal("sent without a token")
+	}
+	if result := EvaluateResponse(consumer, consumer.SuccessCriteria, code, body); result.Success || result.Permanent {
+		t.Fatalf("token failure evaluated as %+v", result)
+	}
+	RemoveConsumerGrpcConns(consumer.Id)
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// HttpClient is a fasthttp client built from an HTTP client profile.
+type HttpClient struct {
+	profile models.HttpClientProfile
+	client  *fasthttp.Client
+}
+
+var (
+	httpClientsMutex sync.Mutex
+	httpClients      = map[string]*HttpClient{}
+)
+
+// profileDuration parses one duration of a profile, falling back to def when
+// it is empty.
+func profileDuration(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+	return d, nil
+}
+
+// ValidateHttpClientProfile checks the durations and limits of a profile.
+func ValidateHttpClientProfile(profile models.HttpClientProfile) error {
+	for name, value := range map[string]string{
+		"connect_timeout":        profile.ConnectTimeout,
+		"read_timeout":           profile.ReadTimeout,
+		"write_timeout":          profile.WriteTimeout,
+		"max_idle_conn_duration": profile.MaxIdleConnDuration,
+	} {
+		if _, err := profileDuration(value, 0); err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	if profile.MaxConnsPerHost < 0 {
+		return fmt.Errorf("max_conns_per_host must not be negative")
+	}
+	return nil
+}
+
+// NewHttpClient builds a client from a profile. Invalid durations fall back
+// to the defaults of the shared client.
+func NewHttpClient(profile models.HttpClientProfile) *HttpClient {
+	c := &fasthttp.Client{
+		MaxConnsPerHost: profile.MaxConnsPerHost,
+	}
+	c.ReadTimeout, _ = profileDuration(profile.ReadTimeout, client.ReadTimeout)
+	c.WriteTimeout, _ = profileDuration(profile.WriteTimeout, client.WriteTimeout)
+	c.MaxIdleConnDuration, _ = profileDuration(profile.MaxIdleConnDuration, client.MaxIdleConnDuration)
+	if connectTimeout, _ := profileDuration(profile.ConnectTimeout, 0); connectTimeout > 0 {
+		c.Dial = func(addr string) (net.Conn, error) {
+			return fasthttp.DialTimeout(addr, connectTimeout)
+		}
+	}
+
+	return &HttpClient{profile: profile, client: c}
+}
+
+// ConsumerHttpClient returns the cached client of a consumer, building it
+// again when the consumer's profile changed. Consumers without a profile use
+// the shared default client.
+func ConsumerHttpClient(consumer *models.ConsumerParams) *HttpClient {
+	if consumer.HttpClient == (models.HttpClientProfile{}) {
+		return defaultHttpClient
+	}
+
+	httpClientsMutex.Lock()
+	defer httpClientsMutex.Unlock()
+
+	c, ok := httpClients[consumer.Id]
+	if ok && c.profile == consumer.HttpClient {
+		return c
+	}
+	if ok {
+		c.client.CloseIdleConnections()
+	}
+	c = NewHttpClient(consumer.HttpClient)
+	httpClients[consumer.Id] = c
+	return c
+}
+
+// RemoveConsumerHttpClient drops the cached client of a consumer and closes
+// its idle connections.
+func RemoveConsumerHttpClient(consumerID string) {
+	httpClientsMutex.Lock()
+	defer httpClientsMutex.Unlock()
+
+	if c, ok := httpClients[consumerID]; ok {
+		c.client.CloseIdleConnections()
+		delete(httpClients, consumerID)
+	}
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidateMetadataMode checks that a consumer's metadata mode is known.
+func ValidateMetadataMode(mode string) error {
+	switch mode {
+	case models.METADATA_NONE, models.METADATA_HEADERS, models.METADATA_ENVELOPE:
+		return nil
+	}
+	return fmt.Errorf("unknown metadata_mode: %s", mode)
+}
+
+// ApplyMetadata attaches message metadata to a callback according to mode and
+// returns the body and the extra headers to send.
+func ApplyMetadata(mode string, metadata *models.MessageMetadata, body string) (string, map[string]string) {
+	if metadata == nil {
+		return body, nil
+	}
+
+	switch mode {
+	case models.METADATA_HEADERS:
+		return body, MetadataHeaders(metadata)
+	case models.METADATA_ENVELOPE:
+		return MetadataEnvelope(metadata, body), nil
+	}
+
+	return body, nil
+}
+
+// MetadataHeaders renders metadata as X-AMQP-* HTTP headers. Application
+// headers become X-AMQP-Header-<name>; non-scalar values are sent as JSON.
+func MetadataHeaders(metadata *models.MessageMetadata) map[string]string {
+	headers := map[string]string{
+		"X-AMQP-Routing-Key":    metadata.RoutingKey,
+		"X-AMQP-Exchange":       metadata.Exchange,
+		"X-AMQP-Message-Id":     metadata.MessageId,
+		"X-AMQP-Correlation-Id": metadata.CorrelationId,
+		"X-AMQP-Redelivered":    strconv.FormatBool(metadata.Redelivered),
+	}
+	if !metadata.Timestamp.IsZero() {
+		headers["X-AMQP-Timestamp"] = metadata.Timestamp.UTC().Format(time.RFC3339)
+	}
+
+	for name, value := range metadata.Headers {
+		var text string
+		switch v := value.(type) {
+		case string:
+			text = v
+		case bool, int, int8, int16, int32, int64, uint8, uint16, uint32, uint64, float32, float64:
+			text = fmt.Sprint(v)
+		default:
+			data, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			text = string(data)
+		}
+		headers["X-AMQP-Header-"+headerToken(name)] = text
+	}
+
+	return headers
+}
+
+// headerToken replaces characters that are not allowed in HTTP header names.
+func headerToken(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 128 && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+// MetadataEnvelope wraps body in a JSON envelope next to the metadata. A JSON
+// body is embedded as is, anything else as a string.
+func MetadataEnvelope(metadata *models.MessageMetadata, body string) string {
+	var payload interface{} = body
+	if json.Valid([]byte(body)) {
+		payload = json.RawMessage(body)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": metadata,
+		"payload":  payload,
+	})
+	if err != nil {
+		return body
+	}
+
+	return string(data)
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// Lane is one serial lane of a partitioned consumer. Its methods do nothing on
+// a nil Lane, which stands for a consumer without lanes.
+type Lane struct {
+	backlog   int32
+	attempt   int32
+	delivered uint64
+}
+
+var (
+	lanesMutex    sync.RWMutex
+	consumerLanes = map[string][]*Lane{}
+)
+
+// PartitionEnabled tells whether a consumer delivers on partition lanes.
+func PartitionEnabled(partition models.Partition) bool {
+	return partition.Lanes > 0
+}
+
+// ValidatePartition checks the lane count and that exactly one key source is
+// set when lanes are on.
+func ValidatePartition(partition models.Partition, maxLanes int) error {
+	if partition.Lanes < 0 || partition.Lanes > maxLanes {
+		return fmt.Errorf("lanes must be between 0 and %d", maxLanes)
+	}
+	if !PartitionEnabled(partition) {
+		return nil
+	}
+	if (partition.Header == "") == (partition.JSONPath == "") {
+		return fmt.Errorf("set either header or json_path")
+	}
+	if err := ValidateSuccessCriteria(models.SuccessCriteria{JSONPath: partition.JSONPath}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// PartitionLane picks the lane of a message. Messages without a key have no
+// order to keep and are spread by fallback instead.
+func PartitionLane(partition models.Partition, metadata *models.MessageMetadata, body string, fallback uint64) int {
+	var key string
+	if partition.Header != "" {
+		if value, ok := metadata.Headers[partition.Header]; ok {
+			key = fmt.Sprint(value)
+		}
+	} else {
+		key, _ = JSONPathValue(body, partition.JSONPath)
+	}
+	if key == "" {
+		return int(fallback % uint64(partition.Lanes))
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(partition.Lanes))
+}
+
+// SetConsumerLanes returns the n lanes of a consumer, keeping the existing
+// ones when the count did not change.
+func SetConsumerLanes(consumerID string, n int) []*Lane {
+	lanesMutex.Lock()
+	defer lanesMutex.Unlock()
+
+	if lanes, ok := consumerLanes[consumerID]; ok && len(lanes) == n {
+		return lanes
+	}
+	lanes := make([]*Lane, n)
+	for i := range lanes {
+		lanes[i] = &Lane{}
+	}
+	consumerLanes[consumerID] = lanes
+	return lanes
+}
+
+// RemoveConsumerLanes forgets the lanes of a stopped consumer.
+func RemoveConsumerLanes(consumerID string) {
+	lanesMutex.Lock()
+	defer lanesMutex.Unlock()
+	delete(consumerLanes, consumerID)
+}
+
+// LaneStates reports the lanes of every partitioned consumer by consumer id.
+func LaneStates() map[string][]models.LaneState {
+	lanesMutex.RLock()
+	defer lanesMutex.RUnlock()
+
+	states := make(map[string][]models.LaneState, len(consumerLanes))
+	for id, lanes := range consumerLanes {
+		for i, lane := range lanes {
+			attempt := int(atomic.LoadInt32(&lane.attempt))
+			states[id] = append(states[id], models.LaneState{
+				Lane:      i,
+				Backlog:   int(atomic.LoadInt32(&lane.backlog)),
+				Blocked:   attempt > 0,
+				Attempt:   attempt,
+				Delivered: atomic.LoadUint64(&lane.delivered),
+			})
+		}
+	}
+	return states
+}
+
+// Queued counts a message handed to the lane.
+func (l *Lane) Queued() {
+	if l != nil {
+		atomic.AddInt32(&l.backlog, 1)
+	}
+}
+
+// Done counts a message the lane settled or gave back.
+func (l *Lane) Done(delivered bool) {
+	if l == nil {
+		return
+	}
+	atomic.AddInt32(&l.backlog, -1)
+	if delivered {
+		atomic.AddUint64(&l.delivered, 1)
+	}
+}
+
+// Retrying marks the lane as blocked on the given retry attempt of its
+// current message; zero unblocks it.
+func (l *Lane) Retrying(attempt int) {
+	if l != nil {
+		atomic.StoreInt32(&l.attempt, int32(attempt))
+	}
+}
@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"sync"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// avroSingleObjectMagic starts an Avro single-object encoded message.
+var avroSingleObjectMagic = []byte{0xC3, 0x01}
+
+// compiledSchema is a stored schema parsed once for decoding.
+type compiledSchema struct {
+	format string
+	avro   *goavro.Codec
+	proto  *protoregistry.Files
+}
+
+var (
+	schemasMutex sync.RWMutex
+	schemas      = map[string]*compiledSchema{}
+)
+
+func compileSchema(schema models.Schema) (*compiledSchema, error) {
+	switch schema.Format {
+	case models.PAYLOAD_AVRO:
+		codec, err := goavro.NewCodec(schema.Definition)
+		if err != nil {
+			return nil, err
+		}
+		return &compiledSchema{format: schema.Format, avro: codec}, nil
+	case models.PAYLOAD_PROTOBUF:
+		data, err := base64.StdEncoding.DecodeString(schema.Definition)
+		if err != nil {
+			return nil, fmt.Errorf("descriptor set is not base64: %s", err.Error())
+		}
+		var set descriptorpb.FileDescriptorSet
+		if err := proto.Unmarshal(data, &set); err != nil {
+			return nil, fmt.Errorf("invalid descriptor set: %s", err.Error())
+		}
+		files, err := protodesc.NewFiles(&set)
+		if err != nil {
+			return nil, fmt.Errorf("invalid descriptor set: %s", err.Error())
+		}
+		return &compiledSchema{format: schema.Format, proto: files}, nil
+	}
+	return nil, fmt.Errorf("unsupported schema format: %s", schema.Format)
+}
+
+// ValidateSchema checks that a schema has a name and that its definition
+// parses.
+func ValidateSchema(schema models.Schema) error {
+	if schema.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	_, err := compileSchema(schema)
+	return err
+}
+
+// SetSchema parses a schema and makes it available to the consumers that
+// decode with it.
+func SetSchema(schema models.Schema) error {
+	compiled, err := compileSchema(schema)
+	if err != nil {
+		return err
+	}
+
+	schemasMutex.Lock()
+	defer schemasMutex.Unlock()
+	schemas[schema.Name] = compiled
+	return nil
+}
+
+// RemoveSchema forgets a deleted schema.
+func RemoveSchema(name string) {
+	schemasMutex.Lock()
+	defer schemasMutex.Unlock()
+	delete(schemas, name)
+}
+
+func lookupSchema(payload models.PayloadFormat) (*compiledSchema, error) {
+	schemasMutex.RLock()
+	schema, ok := schemas[payload.Schema]
+	schemasMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown schema: %s", payload.Schema)
+	}
+	if schema.format != payload.Format {
+		return nil, fmt.Errorf("schema %s is a %s schema", payload.Schema, schema.format)
+	}
+	return schema, nil
+}
+
+func (s *compiledSchema) protoMessage(name string) (protoreflect.MessageDescriptor, error) {
+	descriptor, err := s.proto.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("unknown message type: %s", name)
+	}
+	message, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message type", name)
+	}
+	return message, nil
+}
+
+// ValidatePayloadFormat checks that a payload format is known and that the
+// schema and message type it needs exist.
+func ValidatePayloadFormat(payload models.PayloadFormat) error {
+	switch payload.Format {
+	case "", models.PAYLOAD_MSGPACK:
+		return nil
+	case models.PAYLOAD_AVRO, models.PAYLOAD_PROTOBUF:
+		schema, err := lookupSchema(payload)
+		if err != nil {
+			return err
+		}
+		if payload.Format == models.PAYLOAD_PROTOBUF {
+			_, err = schema.protoMessage(payload.Message)
+		}
+		return err
+	}
+	return fmt.Errorf("unknown format: %s", payload.Format)
+}
+
+// DecodePayload converts a message body of the declared format to JSON.
+func DecodePayload(payload models.PayloadFormat, body []byte) ([]byte, error) {
+	switch payload.Format {
+	case "":
+		return body, nil
+	case models.PAYLOAD_MSGPACK:
+		var value interface{}
+		if err := msgpack.Unmarshal(body, &value); err != nil {
+			return nil, err
+		}
+		return json.Marshal(value)
+	}
+
+	schema, err := lookupSchema(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if payload.Format == models.PAYLOAD_AVRO {
+		var native interface{}
+		if bytes.HasPrefix(body, avroSingleObjectMagic) {
+			native, _, err = schema.avro.NativeFromSingle(body)
+		} else {
+			native, _, err = schema.avro.NativeFromBinary(body)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return schema.avro.TextualFromNative(nil, native)
+	}
+
+	descriptor, err := schema.protoMessage(payload.Message)
+	if err != nil {
+		return nil, err
+	}
+	message := dynamicpb.NewMessage(descriptor)
+	if err := proto.Unmarshal(body, message); err != nil {
+		return nil, err
+	}
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	// protojson output is deliberately unstable in its whitespace.
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		return nil, err
+	}
+	return compact.Bytes(), nil
+}
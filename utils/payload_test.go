@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"go-rabbitmq-consumers/models"
+	"reflect"
+	"testing"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const avroOrderSchema = `{"type":"record","name":"Order","fields":[{"name":"id","type":"long"},{"name":"customer_name","type":"string"}]}`
+
+func orderDescriptorSet(t *testing.T) []byte {
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("order.proto"),
+		Package: proto.String("shop"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Order"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("id"), JsonName: proto.String("id"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+				{Name: proto.String("customer_name"), JsonName: proto.String("customerName"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+			},
+		}},
+	}
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func sameJSON(got []byte, want string) bool {
+	var a, b interface{}
+	return json.Unmarshal(got, &a) == nil && json.Unmarshal([]byte(want), &b) == nil && reflect.DeepEqual(a, b)
+}
+
+func TestDecodePayload(t *testing.T) {
+	const want = `{"id":7,"customer_name":"ada"}`
+
+	// MessagePack needs no schema.
+	body, _ := msgpack.Marshal(map[string]interface{}{"id": 7, "customer_name": "ada"})
+	if got, err := DecodePayload(models.PayloadFormat{Format: models.PAYLOAD_MSGPACK}, body); err != nil || !sameJSON(got, want) {
+		t.Fatalf("msgpack: got %s, %v", got, err)
+	}
+
+	avro := models.Schema{Name: "order-avro", Format: models.PAYLOAD_AVRO, Definition: avroOrderSchema}
+	if err := SetSchema(avro); err != nil {
+		t.Fatal(err)
+	}
+	codec, _ := goavro.NewCodec(avroOrderSchema)
+	body, _ = codec.BinaryFromNative(nil, map[string]interface{}{"id": int64(7), "customer_name": "ada"})
+	if got, err := DecodePayload(models.PayloadFormat{Format: models.PAYLOAD_AVRO, Schema: avro.Name}, body); err != nil || !sameJSON(got, want) {
+		t.Fatalf("avro: got %s, %v", got, err)
+	}
+
+	descriptors := orderDescriptorSet(t)
+	pb := models.Schema{Name: "order-pb", Format: models.PAYLOAD_PROTOBUF, Definition: base64.StdEncoding.EncodeToString(descriptors)}
+	if err := SetSchema(pb); err != nil {
+		t.Fatal(err)
+	}
+	payload := models.PayloadFormat{Format: models.PAYLOAD_PROTOBUF, Schema: pb.Name, Message: "shop.Order"}
+	if err := ValidatePayloadFormat(payload); err != nil {
+		t.Fatal(err)
+	}
+	schema, _ := lookupSchema(payload)
+	descriptor, _ := schema.protoMessage(payload.Message)
+	message := dynamicpb.NewMessage(descriptor)
+	message.Set(descriptor.Fields().ByName("id"), protoreflect.ValueOfInt32(7))
+	message.Set(descriptor.Fields().ByName("customer_name"), protoreflect.ValueOfString("ada"))
+	body, _ = proto.Marshal(message)
+	if got, err := DecodePayload(payload, body); err != nil || !sameJSON(got, want) {
+		t.Fatalf("protobuf: got %s, %v", got, err)
+	}
+
+	if err := ValidatePayloadFormat(models.PayloadFormat{Format: models.PAYLOAD_PROTOBUF, Schema: pb.Name, Message: "shop.Missing"}); err == nil {
+		t.Fatal("unknown message type accepted")
+	}
+	if err := ValidatePayloadFormat(models.PayloadFormat{Format: models.PAYLOAD_AVRO, Schema: pb.Name}); err == nil {
+		t.Fatal("protobuf schema accepted for avro")
+	}
+}
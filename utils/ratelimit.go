@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Throttle is a token bucket that callbacks wait on before they are sent.
+type Throttle struct {
+	limiter   *rate.Limiter
+	waiting   int32
+	throttled uint64
+	waited    int64 // nanoseconds
+}
+
+var (
+	throttlesMutex    sync.RWMutex
+	consumerThrottles = map[string]*Throttle{}
+	hostThrottles     = map[string]*Throttle{}
+)
+
+// ValidateRateLimit checks that a rate limit is not negative.
+func ValidateRateLimit(limit models.RateLimit) error {
+	if limit.Rate < 0 {
+		return fmt.Errorf("rate must not be negative")
+	}
+	if limit.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+	return nil
+}
+
+// rateLimitBurst returns the bucket size of limit, at least one request.
+func rateLimitBurst(limit models.RateLimit) int {
+	if limit.Burst < 1 {
+		return 1
+	}
+	return limit.Burst
+}
+
+// Wait blocks until the bucket has a token or ctx is done.
+func (t *Throttle) Wait(ctx context.Context) error {
+	reservation := t.limiter.Reserve()
+	delay := reservation.Delay()
+	if delay == 0 {
+		return nil
+	}
+
+	atomic.AddUint64(&t.throttled, 1)
+	atomic.AddInt32(&t.waiting, 1)
+	defer atomic.AddInt32(&t.waiting, -1)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		atomic.AddInt64(&t.waited, int64(delay))
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	}
+}
+
+// State reports the current throttle state.
+func (t *Throttle) State() models.ThrottleState {
+	return models.ThrottleState{
+		Rate:      float64(t.limiter.Limit()),
+		Burst:     t.limiter.Burst(),
+		Tokens:    t.limiter.Tokens(),
+		Waiting:   int(atomic.LoadInt32(&t.waiting)),
+		Throttled: atomic.LoadUint64(&t.throttled),
+		WaitedMs:  atomic.LoadInt64(&t.waited) / int64(time.Millisecond),
+	}
+}
+
+// setThrottle applies limit to the throttle stored under key. An existing
+// bucket keeps its tokens; a zero rate removes the limit.
+func setThrottle(throttles map[string]*Throttle, key string, limit models.RateLimit) {
+	throttlesMutex.Lock()
+	defer throttlesMutex.Unlock()
+
+	if limit.Rate <= 0 {
+		delete(throttles, key)
+		return
+	}
+	if t, ok := throttles[key]; ok {
+		t.limiter.SetLimit(rate.Limit(limit.Rate))
+		t.limiter.SetBurst(rateLimitBurst(limit))
+		return
+	}
+	throttles[key] = &Throttle{limiter: rate.NewLimiter(rate.Limit(limit.Rate), rateLimitBurst(limit))}
+}
+
+func throttleStates(throttles map[string]*Throttle) map[string]models.ThrottleState {
+	throttlesMutex.RLock()
+	defer throttlesMutex.RUnlock()
+
+	states := make(map[string]models.ThrottleState, len(throttles))
+	for key, t := range throttles {
+		states[key] = t.State()
+	}
+	return states
+}
+
+// SetConsumerRateLimit sets the rate limit of a consumer's callbacks.
+func SetConsumerRateLimit(consumerID string, limit models.RateLimit) {
+	setThrottle(consumerThrottles, consumerID, limit)
+}
+
+// SetHostRateLimit sets the limit shared by every callback sent to host.
+func SetHostRateLimit(host string, limit models.RateLimit) {
+	setThrottle(hostThrottles, strings.ToLower(host), limit)
+}
+
+// ConsumerThrottleStates reports the throttle state of every rate limited consumer.
+func ConsumerThrottleStates() map[string]models.ThrottleState {
+	return throttleStates(consumerThrottles)
+}
+
+// HostThrottleStates reports the throttle state of every rate limited host.
+func HostThrottleStates() map[string]models.ThrottleState {
+	return throttleStates(hostThrottles)
+}
+
+// CallbackHost returns the host, with port, that a callback URL points to.
+func CallbackHost(callback string) string {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// WaitRateLimit blocks until the consumer's own limit and the limit of the
+// callback host both allow another request, or until ctx is done.
+func WaitRateLimit(ctx context.Context, consumerID, callback string) error {
+	if err := WaitConsumerRateLimit(ctx, consumerID); err != nil {
+		return err
+	}
+	return WaitHostRateLimit(ctx, callback)
+}
+
+// ConsumerRateLimited reports whether the consumer currently has a rate
+// limiter, which only running consumers with a rate limit have.
+func ConsumerRateLimited(consumerID string) bool {
+	throttlesMutex.RLock()
+	defer throttlesMutex.RUnlock()
+
+	_, ok := consumerThrottles[consumerID]
+	return ok
+}
+
+// WaitConsumerRateLimit blocks until the consumer's limit allows another
+// request, or until ctx is done.
+func WaitConsumerRateLimit(ctx context.Context, consumerID string) error {
+	throttlesMutex.RLock()
+	t := consumerThrottles[consumerID]
+	throttlesMutex.RUnlock()
+
+	if t == nil {
+		return nil
+	}
+	return t.Wait(ctx)
+}
+
+// WaitHostRateLimit blocks until the limit of the callback host allows another
+// request, or until ctx is done.
+func WaitHostRateLimit(ctx context.Context, callback string) error {
+	throttlesMutex.RLock()
+	t := hostThrottles[CallbackHost(callback)]
+	throttlesMutex.RUnlock()
+
+	if t == nil {
+		return nil
+	}
+	return t.Wait(ctx)
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// DefaultRetryPolicy reproduces the original 5s, 1m, 5m retry schedule.
+var DefaultRetryPolicy = models.RetryPolicy{
+	MaxAttempts:  3,
+	InitialDelay: "5s",
+	Multiplier:   12,
+	MaxDelay:     "5m",
+}
+
+// ValidateRetryPolicy checks that the durations and factors of a policy are usable.
+func ValidateRetryPolicy(policy models.RetryPolicy) error {
+	if policy.MaxAttempts < 0 {
+		return fmt.Errorf("max_attempts must not be negative")
+	}
+	if policy.Multiplier != 0 && policy.Multiplier < 1 {
+		return fmt.Errorf("multiplier must be at least 1")
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return fmt.Errorf("jitter must be between 0 and 1")
+	}
+	for name, value := range map[string]string{
+		"initial_delay": policy.InitialDelay,
+		"max_delay":     policy.MaxDelay,
+		"deadline":      policy.Deadline,
+	} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("invalid %s: %q", name, value)
+		}
+	}
+
+	return nil
+}
+
+// EffectiveRetryPolicy fills the fields a policy leaves unset from
+// DefaultRetryPolicy, so a policy that only sets initial_delay still retries
+// and one without initial_delay does not retry in a tight loop. Jitter and
+// deadline are off unless set.
+func EffectiveRetryPolicy(policy models.RetryPolicy) models.RetryPolicy {
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if policy.InitialDelay == "" {
+		policy.InitialDelay = DefaultRetryPolicy.InitialDelay
+	}
+	if policy.Multiplier == 0 {
+		policy.Multiplier = DefaultRetryPolicy.Multiplier
+	}
+	if policy.MaxDelay == "" {
+		policy.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+	return policy
+}
+
+// RetryDelay returns how long to wait before retry attempt (starting at 1),
+// given the time already spent retrying. ok is false once the policy allows no
+// further attempt.
+func RetryDelay(policy models.RetryPolicy, attempt int, elapsed time.Duration) (delay time.Duration, ok bool) {
+	policy = EffectiveRetryPolicy(policy)
+	if attempt < 1 || attempt > policy.MaxAttempts {
+		return 0, false
+	}
+
+	initial, _ := time.ParseDuration(policy.InitialDelay)
+	multiplier := math.Max(policy.Multiplier, 1)
+	backoff := float64(initial) * math.Pow(multiplier, float64(attempt-1))
+
+	maxDelay, _ := time.ParseDuration(policy.MaxDelay)
+	if maxDelay <= 0 {
+		maxDelay = math.MaxInt64 / 2
+	}
+	if backoff > float64(maxDelay) {
+		delay = maxDelay
+	} else {
+		delay = time.Duration(backoff)
+	}
+	if policy.Jitter > 0 {
+		delay += time.Duration(float64(delay) * policy.Jitter * (2*rand.Float64() - 1))
+	}
+	if deadline, err := time.ParseDuration(policy.Deadline); err == nil && deadline > 0 && elapsed+delay > deadline {
+		return 0, false
+	}
+
+	return delay, true
+}
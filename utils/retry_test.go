@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"go-rabbitmq-consumers/models"
+	"testing"
+	"time"
+)
+
+func TestRetryDelayPartialPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  models.RetryPolicy
+		attempt int
+		delay   time.Duration
+		ok      bool
+	}{
+		{"empty policy", models.RetryPolicy{}, 1, 5 * time.Second, true},
+		{"empty policy second", models.RetryPolicy{}, 2, time.Minute, true},
+		{"empty policy capped", models.RetryPolicy{}, 3, 5 * time.Minute, true},
+		{"empty policy exhausted", models.RetryPolicy{}, 4, 0, false},
+		{"only initial delay", models.RetryPolicy{InitialDelay: "1s"}, 2, 12 * time.Second, true},
+		{"only initial delay exhausted", models.RetryPolicy{InitialDelay: "1s"}, 4, 0, false},
+		{"only max attempts", models.RetryPolicy{MaxAttempts: 5}, 1, 5 * time.Second, true},
+		{"only max attempts last", models.RetryPolicy{MaxAttempts: 5}, 5, 5 * time.Minute, true},
+		{"only max delay", models.RetryPolicy{MaxDelay: "30s"}, 2, 30 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, ok := RetryDelay(tt.policy, tt.attempt, 0)
+			if ok != tt.ok || delay != tt.delay {
+				t.Fatalf("RetryDelay = %s, %v; want %s, %v", delay, ok, tt.delay, tt.ok)
+			}
+		})
+	}
+}
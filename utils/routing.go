@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"strings"
+)
+
+// ValidateRoutingRules checks that every rule has a callback and at least one
+// condition.
+func ValidateRoutingRules(rules []models.RoutingRule) error {
+	for i, rule := range rules {
+		if rule.Callback == "" {
+			return fmt.Errorf("rule %d has no callback", i)
+		}
+		if rule.RoutingKey == "" && rule.Header == "" && rule.JSONPath == "" {
+			return fmt.Errorf("rule %d has no condition", i)
+		}
+		if rule.HeaderValue != "" && rule.Header == "" {
+			return fmt.Errorf("rule %d has a header_value without header", i)
+		}
+	}
+	return nil
+}
+
+// MatchRoute returns the first rule whose conditions all match the message.
+func MatchRoute(rules []models.RoutingRule, metadata *models.MessageMetadata, body string) (models.RoutingRule, bool) {
+	for _, rule := range rules {
+		if routeMatches(rule, metadata, body) {
+			return rule, true
+		}
+	}
+	return models.RoutingRule{}, false
+}
+
+func routeMatches(rule models.RoutingRule, metadata *models.MessageMetadata, body string) bool {
+	if rule.RoutingKey != "" && !TopicMatch(rule.RoutingKey, metadata.RoutingKey) {
+		return false
+	}
+	if rule.Header != "" {
+		value, ok := metadata.Headers[rule.Header]
+		if !ok || rule.HeaderValue != "" && fmt.Sprint(value) != rule.HeaderValue {
+			return false
+		}
+	}
+	if rule.JSONPath != "" {
+		value, err := JSONPathValue(body, rule.JSONPath)
+		if err != nil || value != rule.JSONValue {
+			return false
+		}
+	}
+	return true
+}
+
+// TopicMatch matches a routing key against an AMQP topic pattern, where "*"
+// stands for exactly one word and "#" for zero or more words.
+func TopicMatch(pattern, key string) bool {
+	return topicMatch(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func topicMatch(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	if pattern[0] == "#" {
+		for i := 0; i <= len(words); i++ {
+			if topicMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(words) == 0 || pattern[0] != "*" && pattern[0] != words[0] {
+		return false
+	}
+	return topicMatch(pattern[1:], words[1:])
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"go-rabbitmq-consumers/models"
+	"testing"
+)
+
+func TestMatchRoute(t *testing.T) {
+	rules := []models.RoutingRule{
+		{RoutingKey: "order.*.paid", Callback: "http://orders/paid"},
+		{Header: "event", HeaderValue: "refund", Callback: "http://refunds"},
+		{RoutingKey: "user.#", JSONPath: "type", JSONValue: "signup", Callback: "http://signups"},
+		{RoutingKey: "#.audit", Callback: "http://audit"},
+	}
+
+	tests := []struct {
+		name       string
+		routingKey string
+		headers    map[string]interface{}
+		body       string
+		callback   string
+	}{
+		{"topic word", "order.eu.paid", nil, `{}`, "http://orders/paid"},
+		{"topic word count", "order.eu.x.paid", nil, `{}`, ""},
+		{"header value", "misc", map[string]interface{}{"event": "refund"}, `{}`, "http://refunds"},
+		{"header mismatch", "misc", map[string]interface{}{"event": "sale"}, `{}`, ""},
+		{"json path", "user", nil, `{"type":"signup"}`, "http://signups"},
+		{"json path mismatch", "user.eu", nil, `{"type":"login"}`, ""},
+		{"hash matches zero words", "audit", nil, `{}`, "http://audit"},
+		{"first rule wins", "order.eu.paid", map[string]interface{}{"event": "refund"}, `{}`, "http://orders/paid"},
+	}
+
+	for _, tt := range tests {
+		metadata := &models.MessageMetadata{RoutingKey: tt.routingKey, Headers: tt.headers}
+		rule, ok := MatchRoute(rules, metadata, tt.body)
+		if ok != (tt.callback != "") || rule.Callback != tt.callback {
+			t.Errorf("%s: got %q (matched %v), want %q", tt.name, rule.Callback, ok, tt.callback)
+		}
+	}
+}
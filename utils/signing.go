@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers added to signed callbacks. The signature header carries one
+// "sha256=<hex>" entry per active secret, separated by commas.
+const (
+	HEADER_SIGNATURE_TIMESTAMP = "X-Signature-Timestamp"
+	HEADER_SIGNATURE           = "X-Signature"
+)
+
+// ValidateCallbackSigning checks the rotation fields of a signing config.
+func ValidateCallbackSigning(signing models.CallbackSigning) error {
+	if signing.Secret == REDACTED || signing.PreviousSecret == REDACTED {
+		return fmt.Errorf("secrets must be sent in full, not as %s", REDACTED)
+	}
+	if signing.PreviousExpiresAt != "" {
+		if _, err := time.Parse(time.RFC3339, signing.PreviousExpiresAt); err != nil {
+			return fmt.Errorf("invalid previous_expires_at: %q", signing.PreviousExpiresAt)
+		}
+	}
+	if signing.Secret == "" && signing.PreviousSecret != "" {
+		return fmt.Errorf("previous_secret needs a secret")
+	}
+
+	return nil
+}
+
+// RedactCallbackSigning hides the secrets of a signing config for API
+// responses.
+func RedactCallbackSigning(signing models.CallbackSigning) models.CallbackSigning {
+	signing.Secret = redact(signing.Secret)
+	signing.PreviousSecret = redact(signing.PreviousSecret)
+	return signing
+}
+
+// RestoreCallbackSigning puts back the stored secrets that an update sent as
+// REDACTED.
+func RestoreCallbackSigning(signing, stored models.CallbackSigning) models.CallbackSigning {
+	if signing.Secret == REDACTED {
+		signing.Secret = stored.Secret
+	}
+	if signing.PreviousSecret == REDACTED {
+		signing.PreviousSecret = stored.PreviousSecret
+	}
+	return signing
+}
+
+// NewSigningSecret generates a random 32 byte secret encoded as hex.
+func NewSigningSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// RotateSigningSecret makes secret the current signing secret and keeps the
+// old one valid for the grace period.
+func RotateSigningSecret(signing models.CallbackSigning, secret string, grace time.Duration) models.CallbackSigning {
+	rotated := models.CallbackSigning{Secret: secret}
+	if signing.Secret != "" && grace > 0 {
+		rotated.PreviousSecret = signing.Secret
+		rotated.PreviousExpiresAt = time.Now().Add(grace).UTC().Format(time.RFC3339)
+	}
+	return rotated
+}
+
+// activeSecrets returns the secrets that currently sign callbacks.
+func activeSecrets(signing models.CallbackSigning, now time.Time) []string {
+	var secrets []string
+
+	if signing.Secret != "" {
+		secrets = append(secrets, signing.Secret)
+	}
+	if signing.PreviousSecret != "" {
+		if expiresAt, err := time.Parse(time.RFC3339, signing.PreviousExpiresAt); err == nil && now.Before(expiresAt) {
+			secrets = append(secrets, signing.PreviousSecret)
+		}
+	}
+
+	return secrets
+}
+
+// Sign computes the hex HMAC-SHA256 of "<timestamp>.<body>" with secret.
+func Sign(secret, timestamp, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureHeaders returns the timestamp and signature headers for body, or
+// nil when signing is not configured.
+func SignatureHeaders(signing models.CallbackSigning, body string, now time.Time) map[string]string {
+	secrets := activeSecrets(signing, now)
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signatures := make([]string, len(secrets))
+	for i, secret := range secrets {
+		signatures[i] = "sha256=" + Sign(secret, timestamp, body)
+	}
+
+	return map[string]string{
+		HEADER_SIGNATURE_TIMESTAMP: timestamp,
+		HEADER_SIGNATURE:           strings.Join(signatures, ","),
+	}
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"go-rabbitmq-consumers/models"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	// Computed with: printf '1700000000.{"id":1}' | openssl dgst -sha256 -hmac whsec_test
+	const want = "2f441ba4b3b2d50d28a9ab9d9fd8880376ecd1eb5d0435401553f5d8d0a5dcf8"
+	if got := Sign("whsec_test", "1700000000", `{"id":1}`); got != want {
+		t.Fatalf("Sign = %s, want %s", got, want)
+	}
+}
+
+func TestSignatureHeadersTimestamp(t *testing.T) {
+	signing := models.CallbackSigning{Secret: "whsec_test"}
+	body := `{"id":1}`
+
+	headers := SignatureHeaders(signing, body, time.Unix(1700000000, 0))
+	if headers[HEADER_SIGNATURE_TIMESTAMP] != "1700000000" {
+		t.Fatalf("timestamp header = %q", headers[HEADER_SIGNATURE_TIMESTAMP])
+	}
+	if headers[HEADER_SIGNATURE] != "sha256=2f441ba4b3b2d50d28a9ab9d9fd8880376ecd1eb5d0435401553f5d8d0a5dcf8" {
+		t.Fatalf("signature header = %q", headers[HEADER_SIGNATURE])
+	}
+
+	// The same body a second later signs differently, so a replayed signature
+	// does not match a new timestamp.
+	later := SignatureHeaders(signing, body, time.Unix(1700000001, 0))
+	if later[HEADER_SIGNATURE] != "sha256=5d1660afdffdc0e7e0b80abba2da86ffcbe766a26364d961d8c2c43416778b2a" {
+		t.Fatalf("signature header a second later = %q", later[HEADER_SIGNATURE])
+	}
+
+	if headers := SignatureHeaders(models.CallbackSigning{}, body, time.Now()); headers != nil {
+		t.Fatalf("unsigned config returned headers %v", headers)
+	}
+}
+
+func TestSigningRotationOverlap(t *testing.T) {
+	body := `{"id":1}`
+	rotated := RotateSigningSecret(models.CallbackSigning{Secret: "old"}, "new", time.Hour)
+	if rotated.Secret != "new" || rotated.PreviousSecret != "old" {
+		t.Fatalf("RotateSigningSecret = %+v", rotated)
+	}
+	if err := ValidateCallbackSigning(rotated); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, rotated.PreviousExpiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		previous bool
+	}{
+		{"during grace period", expiresAt.Add(-time.Minute), true},
+		{"after grace period", expiresAt.Add(time.Minute), false},
+	}
+	for _, tt := range tests {
+		headers := SignatureHeaders(rotated, body, tt.now)
+		timestamp := headers[HEADER_SIGNATURE_TIMESTAMP]
+		want := "sha256=" + Sign("new", timestamp, body)
+		if tt.previous {
+			want += ",sha256=" + Sign("old", timestamp, body)
+		}
+		if headers[HEADER_SIGNATURE] != want {
+			t.Errorf("%s: signature header = %q, want %q", tt.name, headers[HEADER_SIGNATURE], want)
+		}
+	}
+
+	if rotated := RotateSigningSecret(models.CallbackSigning{Secret: "old"}, "new", 0); rotated.PreviousSecret != "" {
+		t.Fatalf("rotation without grace period kept %+v", rotated)
+	}
+}
@@ -0,0 +1,516 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
+	"github.com/streadway/amqp"
+)
+
+// DEFAULT_SINK_TIMEOUT bounds a command or a republish without a configured
+// timeout.
+const DEFAULT_SINK_TIMEOUT = 30 * time.Second
+
+// Sink results are reported like a command: 0 means success. Commands report
+// their exit code, and -1 when they could not run to the end.
+const (
+	SINK_OK     = 0
+	SINK_FAILED = 1
+	SINK_ABORT  = -1
+)
+
+// fileSink is an open rotating JSONL file.
+type fileSink struct {
+	settings models.SinkSettings
+	writer   *rotatelogs.RotateLogs
+}
+
+// amqpSink is a confirmed publisher channel to a broker. It reconnects on the
+// next publish after a failure.
+type amqpSink struct {
+	mutex    sync.Mutex
+	url      string
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+// sinkRecord is one line of a file sink. A JSON body is embedded as is.
+type sinkRecord struct {
+	Time       time.Time               `json:"time"`
+	ConsumerId string                  `json:"consumer_id"`
+	QueueName  string                  `json:"queue_name"`
+	Metadata   *models.MessageMetadata `json:"metadata,omitempty"`
+	Headers    map[string]string       `json:"headers,omitempty"`
+	Body       interface{}             `json:"body"`
+}
+
+var (
+	sinksMutex sync.Mutex
+	fileSinks  = map[string]*fileSink{}
+	// amqpSinks holds the broker connections of each consumer by broker URL.
+	amqpSinks = map[string]map[string]*amqpSink{}
+)
+
+// execSinkCommands is the server-side allowlist of programs exec sinks may
+// run, by absolute path. It is set once at startup; while it is empty exec
+// sinks are disabled.
+var execSinkCommands = map[string]bool{}
+
+// execSinkPath is the only PATH exec sink commands see, instead of the
+// environment of the server.
+const execSinkPath = "PATH=/usr/local/bin:/usr/bin:/bin"
+
+// fileSinkDir is the directory file sinks write in, set once at startup.
+// While it is empty file sinks are disabled.
+var fileSinkDir string
+
+// SetFileSinkDir sets the directory file sinks write in.
+func SetFileSinkDir(dir string) {
+	fileSinkDir = dir
+}
+
+// fileSinkPath resolves the path of a file sink, following symlinks, and
+// checks that it lies inside the sink directory and is either new or the link
+// a file sink keeps to its current file.
+func fileSinkPath(path string) (string, error) {
+	if fileSinkDir == "" {
+		return "", fmt.Errorf("file sinks are disabled: no sink directory is configured")
+	}
+	for _, part := range strings.Split(path, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("path must not contain ..: %s", path)
+		}
+	}
+	base, err := filepath.EvalSymlinks(fileSinkDir)
+	if err != nil {
+		return "", fmt.Errorf("sink directory: %s", err.Error())
+	}
+
+	// The file itself may be the sink's link and is looked at below. Missing
+	// directories are created on the first write, so only the part of the
+	// directory that exists can be resolved.
+	resolved, rest := filepath.Dir(filepath.Clean(path)), filepath.Base(path)
+	for {
+		if real, err := filepath.EvalSymlinks(resolved); err == nil {
+			resolved = filepath.Join(real, rest)
+			break
+		}
+		parent := filepath.Dir(resolved)
+		if parent == resolved {
+			return "", fmt.Errorf("cannot resolve %s", path)
+		}
+		rest = filepath.Join(filepath.Base(resolved), rest)
+		resolved = parent
+	}
+	if rel, err := filepath.Rel(base, resolved); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("path is outside the sink directory: %s", path)
+	}
+
+	info, err := os.Lstat(resolved)
+	if os.IsNotExist(err) {
+		return resolved, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(resolved)
+		if err == nil && strings.HasPrefix(filepath.Base(target), filepath.Base(resolved)+".") &&
+			(filepath.Dir(target) == "." || filepath.Dir(target) == filepath.Dir(resolved)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("path exists and is not a file sink: %s", path)
+}
+
+// SetExecSinkCommands sets the programs exec sinks may run.
+func SetExecSinkCommands(commands []string) {
+	execSinkCommands = map[string]bool{}
+	for _, command := range commands {
+		if command != "" {
+			execSinkCommands[filepath.Clean(command)] = true
+		}
+	}
+}
+
+// checkExecSinkCommand reports an error unless the allowlist has command.
+func checkExecSinkCommand(command string) error {
+	if len(execSinkCommands) == 0 {
+		return fmt.Errorf("exec sinks are disabled: no commands are allowed")
+	}
+	if command != filepath.Clean(command) || !execSinkCommands[command] {
+		return fmt.Errorf("command is not allowed: %s", command)
+	}
+	return nil
+}
+
+func validateSinkSettings(settings models.SinkSettings) error {
+	for name, value := range map[string]string{
+		"rotation_time": settings.RotationTime,
+		"max_age":       settings.MaxAge,
+		"timeout":       settings.Timeout,
+	} {
+		if _, err := profileDuration(value, 0); err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	if settings.RotationSize < 0 {
+		return fmt.Errorf("rotation_size must not be negative")
+	}
+	return nil
+}
+
+// SinkRequest hands a message to the consumer's sink at a file://, exec:// or
+// amqp:// URL. It returns the command output or the error text, and the sink
+// result code.
+func SinkRequest(consumer *models.ConsumerParams, callback, body string, headers map[string]string, metadata *models.MessageMetadata) (string, error, int) {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return err.Error(), err, SINK_FAILED
+	}
+
+	requestHeaders := map[string]string{}
+	for k, v := range consumer.CallbackHeaders {
+		requestHeaders[k] = v
+	}
+	for k, v := range headers {
+		requestHeaders[k] = v
+	}
+
+	switch consumer.Transport {
+	case models.TRANSPORT_FILE:
+		err = writeFileSink(consumer, u.Path, body, requestHeaders, metadata)
+	case models.TRANSPORT_EXEC:
+		return runExecSink(consumer, u, body, requestHeaders, metadata)
+	case models.TRANSPORT_AMQP:
+		err = publishAmqpSink(consumer, u, body, requestHeaders, metadata)
+	default:
+		err = fmt.Errorf("%s is not a sink transport", consumer.Transport)
+	}
+	if err != nil {
+		return err.Error(), err, SINK_FAILED
+	}
+	return "", nil, SINK_OK
+}
+
+// EvaluateSink maps a sink result code to a result.
+func EvaluateSink(code int, output string) RuleResult {
+	switch code {
+	case SINK_OK:
+		return RuleResult{Success: true, Rule: RULE_SINK, Reason: "sink accepted the message"}
+	case SINK_ABORT:
+		return RuleResult{Rule: RULE_SINK, Reason: "sink did not finish: " + output}
+	}
+	return RuleResult{Rule: RULE_SINK, Reason: fmt.Sprintf("sink failed with code %d: %s", code, output)}
+}
+
+// openFileSink returns the rotating writer of a file sink, reopened when the
+// consumer's settings changed.
+func openFileSink(path string, settings models.SinkSettings) (*rotatelogs.RotateLogs, error) {
+	sinksMutex.Lock()
+	defer sinksMutex.Unlock()
+
+	if sink, ok := fileSinks[path]; ok {
+		if sink.settings == settings {
+			return sink.writer, nil
+		}
+		sink.writer.Close()
+		delete(fileSinks, path)
+	}
+
+	// Checked again here, the sink directory may have changed since the
+	// consumer was saved.
+	resolved, err := fileSinkPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rotation, _ := profileDuration(settings.RotationTime, 24*time.Hour)
+	maxAge, _ := profileDuration(settings.MaxAge, 0)
+	pattern := resolved + ".%Y%m%d"
+	if rotation < 24*time.Hour {
+		pattern = resolved + ".%Y%m%d%H%M"
+	}
+	options := []rotatelogs.Option{
+		rotatelogs.WithLinkName(resolved),
+		rotatelogs.WithRotationTime(rotation),
+		rotatelogs.WithMaxAge(-1),
+	}
+	if maxAge > 0 {
+		options[2] = rotatelogs.WithMaxAge(maxAge)
+	}
+	if settings.RotationSize > 0 {
+		options = append(options, rotatelogs.WithRotationSize(settings.RotationSize))
+	}
+
+	writer, err := rotatelogs.New(pattern, options...)
+	if err != nil {
+		return nil, err
+	}
+	fileSinks[path] = &fileSink{settings: settings, writer: writer}
+	return writer, nil
+}
+
+func writeFileSink(consumer *models.ConsumerParams, path, body string, headers map[string]string, metadata *models.MessageMetadata) error {
+	writer, err := openFileSink(path, consumer.Sink)
+	if err != nil {
+		return err
+	}
+
+	record := sinkRecord{
+		Time:       time.Now(),
+		ConsumerId: consumer.Id,
+		QueueName:  consumer.QueueName,
+		Metadata:   metadata,
+		Body:       body,
+	}
+	if len(headers) > 0 {
+		record.Headers = headers
+	}
+	if json.Valid([]byte(body)) {
+		record.Body = json.RawMessage(body)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(line, '\n'))
+	return err
+}
+
+// sinkEnv describes a message to a command in RCH_* environment variables.
+// Headers become RCH_HEADER_<NAME>.
+func sinkEnv(consumer *models.ConsumerParams, headers map[string]string, metadata *models.MessageMetadata) []string {
+	env := []string{
+		"RCH_CONSUMER_ID=" + consumer.Id,
+		"RCH_QUEUE_NAME=" + consumer.QueueName,
+	}
+	if metadata != nil {
+		env = append(env,
+			"RCH_ROUTING_KEY="+metadata.RoutingKey,
+			"RCH_EXCHANGE="+metadata.Exchange,
+			"RCH_MESSAGE_ID="+metadata.MessageId,
+			"RCH_CORRELATION_ID="+metadata.CorrelationId,
+		)
+	}
+	for k, v := range headers {
+		name := strings.ToUpper(strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+				return r
+			}
+			return '_'
+		}, k))
+		env = append(env, "RCH_HEADER_"+name+"="+v)
+	}
+	return env
+}
+
+func runExecSink(consumer *models.ConsumerParams, u *url.URL, body string, headers map[string]string, metadata *models.MessageMetadata) (string, error, int) {
+	// Checked again here, the allowlist may have changed since the consumer
+	// was saved.
+	if err := checkExecSinkCommand(u.Path); err != nil {
+		return err.Error(), err, SINK_FAILED
+	}
+
+	timeout, _ := profileDuration(consumer.Sink.Timeout, DEFAULT_SINK_TIMEOUT)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, u.Path, u.Query()["arg"]...)
+	cmd.Stdin = strings.NewReader(body)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append([]string{execSinkPath}, sinkEnv(consumer, headers, metadata)...)
+
+	err := cmd.Run()
+	if err == nil {
+		return output.String(), nil, SINK_OK
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		return output.String(), err, exitErr.ExitCode()
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	return strings.TrimSpace(output.String() + "\n" + err.Error()), err, SINK_ABORT
+}
+
+func publishAmqpSink(consumer *models.ConsumerParams, u *url.URL, body string, headers map[string]string, metadata *models.MessageMetadata) error {
+	query := u.Query()
+	broker := *u
+	broker.RawQuery = ""
+
+	sinksMutex.Lock()
+	sinks := amqpSinks[consumer.Id]
+	sink, ok := sinks[broker.String()]
+	if !ok {
+		// The connections to brokers the consumer no longer sends to are
+		// closed when it opens a new one.
+		current := sinkBrokers(consumer)
+		for url, old := range sinks {
+			if !current[url] {
+				old.shutdown()
+				delete(sinks, url)
+			}
+		}
+		if sinks == nil {
+			sinks = map[string]*amqpSink{}
+			amqpSinks[consumer.Id] = sinks
+		}
+		sink = &amqpSink{url: broker.String()}
+		sinks[sink.url] = sink
+	}
+	sinksMutex.Unlock()
+
+	msg := amqp.Publishing{
+		Headers:      amqp.Table{},
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         []byte(body),
+	}
+	routingKey := query.Get("routing_key")
+	if metadata != nil {
+		for k, v := range metadata.Headers {
+			msg.Headers[k] = v
+		}
+		msg.ContentType = metadata.ContentType
+		msg.MessageId = metadata.MessageId
+		msg.CorrelationId = metadata.CorrelationId
+		if routingKey == "" {
+			routingKey = metadata.RoutingKey
+		}
+	}
+	for k, v := range headers {
+		msg.Headers[k] = v
+	}
+	// Transforms may have decoded or rewritten the body.
+	msg.ContentEncoding = ""
+
+	timeout, _ := profileDuration(consumer.Sink.Timeout, DEFAULT_SINK_TIMEOUT)
+	return sink.publish(query.Get("exchange"), routingKey, msg, timeout)
+}
+
+// sinkBrokers returns the broker URLs of the amqp sinks a consumer sends to.
+func sinkBrokers(consumer *models.ConsumerParams) map[string]bool {
+	urls := []string{}
+	for _, target := range CallbackTargets(consumer) {
+		urls = append(urls, target.URL)
+	}
+	for _, rule := range consumer.RoutingRules {
+		urls = append(urls, rule.Callback)
+	}
+
+	brokers := map[string]bool{}
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		u.RawQuery = ""
+		brokers[u.String()] = true
+	}
+	return brokers
+}
+
+// RemoveConsumerAmqpSinks closes the broker connections of a consumer's amqp
+// sinks once it stops.
+func RemoveConsumerAmqpSinks(consumerID string) {
+	sinksMutex.Lock()
+	defer sinksMutex.Unlock()
+
+	for _, sink := range amqpSinks[consumerID] {
+		sink.shutdown()
+	}
+	delete(amqpSinks, consumerID)
+}
+
+// publish sends one message as mandatory and waits for the broker to
+// confirm it. A message no queue took comes back and fails the publish.
+func (s *amqpSink) publish(exchange, routingKey string, msg amqp.Publishing, timeout time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn == nil || s.conn.IsClosed() {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.ch.Publish(exchange, routingKey, true, false, msg); err != nil {
+		s.close()
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case confirm, ok := <-s.confirms:
+		if !ok {
+			s.close()
+			return fmt.Errorf("channel closed before the publish was confirmed")
+		}
+		if !confirm.Ack {
+			return fmt.Errorf("broker rejected the message")
+		}
+		// The broker returns an unroutable message before it confirms it.
+		select {
+		case r := <-s.returns:
+			return fmt.Errorf("no queue took the message: %s", r.ReplyText)
+		default:
+			return nil
+		}
+	case <-timer.C:
+		// A late confirmation would be taken for the next message.
+		s.close()
+		return fmt.Errorf("no publish confirmation after %s", timeout)
+	}
+}
+
+func (s *amqpSink) connect() error {
+	conn, err := amqp.Dial(s.url)
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn, s.ch = conn, ch
+	s.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	s.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	return nil
+}
+
+// shutdown closes the connection once no publish is using it.
+func (s *amqpSink) shutdown() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.close()
+}
+
+func (s *amqpSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn, s.ch, s.confirms, s.returns = nil, nil, nil, nil
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"fmt"
+	"go-rabbitmq-consumers/models"
+)
+
+// successCriteriaSet reports whether any success rule was configured.
+func successCriteriaSet(criteria models.SuccessCriteria) bool {
+	return len(criteria.StatusCodes) > 0 || criteria.StatusCodeOnly || criteria.JSONPath != "" || criteria.ExpectedValue != ""
+}
+
+// CallbackTargets returns every target a consumer delivers to, the primary
+// Callback first, each with the success criteria that apply to it.
+func CallbackTargets(consumer *models.ConsumerParams) []models.CallbackTarget {
+	targets := []models.CallbackTarget{{URL: consumer.Callback, SuccessCriteria: consumer.SuccessCriteria}}
+	for _, target := range consumer.CallbackTargets {
+		if !successCriteriaSet(target.SuccessCriteria) {
+			target.SuccessCriteria = consumer.SuccessCriteria
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// TargetCriteria returns the success criteria of the consumer target at url.
+func TargetCriteria(consumer *models.ConsumerParams, url string) models.SuccessCriteria {
+	for _, target := range CallbackTargets(consumer) {
+		if target.URL == url {
+			return target.SuccessCriteria
+		}
+	}
+	return consumer.SuccessCriteria
+}
+
+// ValidateCallbackTargets checks the extra targets and the ack policy of a
+// consumer. Failed callbacks are recorded per URL, so URLs must be unique.
+func ValidateCallbackTargets(consumer *models.ConsumerParams) error {
+	switch consumer.AckPolicy {
+	case "", models.ACK_POLICY_ALL, models.ACK_POLICY_ANY, models.ACK_POLICY_PRIMARY:
+	default:
+		return fmt.Errorf("unknown ack_policy: %s", consumer.AckPolicy)
+	}
+
+	seen := map[string]bool{consumer.Callback: true}
+	for i, target := range consumer.CallbackTargets {
+		if target.URL == "" {
+			return fmt.Errorf("target %d has no url", i)
+		}
+		if seen[target.URL] {
+			return fmt.Errorf("duplicate target url: %s", target.URL)
+		}
+		seen[target.URL] = true
+		if err := ValidateSuccessCriteria(target.SuccessCriteria); err != nil {
+			return fmt.Errorf("target %s: %s", target.URL, err.Error())
+		}
+	}
+	return nil
+}
+
+// AckResult combines the results of the targets of one message, primary first,
+// under an ack policy. A failed combination carries the deciding failure.
+func AckResult(policy string, results []RuleResult) RuleResult {
+	switch policy {
+	case models.ACK_POLICY_PRIMARY:
+		return results[0]
+	case models.ACK_POLICY_ANY:
+		for _, result := range results {
+			if result.Success {
+				return result
+			}
+		}
+		return results[0]
+	}
+
+	for _, result := range results {
+		if !result.Success {
+			return result
+		}
+	}
+	return results[0]
+}
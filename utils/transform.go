@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"io"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DEFAULT_MAX_DECOMPRESSED_BYTES bounds what a decompress step without
+// max_bytes may produce, so a small compressed message cannot exhaust memory.
+const DEFAULT_MAX_DECOMPRESSED_BYTES = 16 << 20
+
+// templateData is what a template step renders. JSON is the decoded body, or
+// nil when the body is not JSON.
+type templateData struct {
+	Body     string
+	JSON     interface{}
+	Metadata *models.MessageMetadata
+}
+
+var (
+	templateFuncs = template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}
+	templates sync.Map // template text -> *template.Template
+)
+
+// ValidateTransforms checks that every step is known and complete, and that
+// templates parse.
+func ValidateTransforms(steps []models.TransformStep) error {
+	for i, step := range steps {
+		switch step.Type {
+		case models.TRANSFORM_BASE64_DECODE:
+		case models.TRANSFORM_DECOMPRESS:
+			if _, err := decompressor(step.Encoding, step.MaxBytes); err != nil {
+				return fmt.Errorf("step %d: %s", i, err.Error())
+			}
+			if step.MaxBytes < 0 {
+				return fmt.Errorf("step %d: max_bytes must not be negative", i)
+			}
+		case models.TRANSFORM_JSON_EXTRACT:
+			if step.Path == "" {
+				return fmt.Errorf("step %d: json_extract needs a path", i)
+			}
+		case models.TRANSFORM_TEMPLATE:
+			if _, err := parseTemplate(step.Template); err != nil {
+				return fmt.Errorf("step %d: %s", i, err.Error())
+			}
+		default:
+			return fmt.Errorf("step %d: unknown type %q", i, step.Type)
+		}
+	}
+	return nil
+}
+
+// ApplyTransforms runs the transform steps over a message body in order. A
+// binary payload is decoded to JSON once the byte level steps (base64 and
+// decompression) ran, before the first JSON step. The error names the step
+// that failed.
+func ApplyTransforms(steps []models.TransformStep, payload models.PayloadFormat, body []byte, metadata *models.MessageMetadata) ([]byte, error) {
+	decoded := false
+	decode := func() error {
+		var err error
+		if body, err = DecodePayload(payload, body); err != nil {
+			return fmt.Errorf("payload decode (%s): %s", payload.Format, err.Error())
+		}
+		decoded = true
+		return nil
+	}
+
+	for i, step := range steps {
+		if !decoded && step.Type != models.TRANSFORM_BASE64_DECODE && step.Type != models.TRANSFORM_DECOMPRESS {
+			if err := decode(); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		if body, err = applyTransform(step, body, metadata); err != nil {
+			return nil, fmt.Errorf("transform step %d (%s): %s", i, step.Type, err.Error())
+		}
+	}
+	if !decoded {
+		if err := decode(); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+func applyTransform(step models.TransformStep, body []byte, metadata *models.MessageMetadata) ([]byte, error) {
+	switch step.Type {
+	case models.TRANSFORM_BASE64_DECODE:
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	case models.TRANSFORM_DECOMPRESS:
+		encoding := step.Encoding
+		if encoding == "" {
+			encoding = metadata.ContentEncoding
+		}
+		decompress, err := decompressor(encoding, step.MaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		return decompress(body)
+	case models.TRANSFORM_JSON_EXTRACT:
+		value, err := JSONPathValue(string(body), step.Path)
+		return []byte(value), err
+	case models.TRANSFORM_TEMPLATE:
+		tmpl, err := parseTemplate(step.Template)
+		if err != nil {
+			return nil, err
+		}
+		data := templateData{Body: string(body), Metadata: metadata}
+		if json.Valid(body) {
+			json.Unmarshal(body, &data.JSON)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown type %q", step.Type)
+}
+
+// decompressor returns the decoder of a content encoding, which fails once
+// the output grows past maxBytes (DEFAULT_MAX_DECOMPRESSED_BYTES when zero).
+// An empty or identity encoding leaves the body unchanged.
+func decompressor(encoding string, maxBytes int64) (func([]byte) ([]byte, error), error) {
+	if maxBytes <= 0 {
+		maxBytes = DEFAULT_MAX_DECOMPRESSED_BYTES
+	}
+
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return func(body []byte) ([]byte, error) { return body, nil }, nil
+	case "gzip", "x-gzip":
+		return func(body []byte) ([]byte, error) {
+			reader, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return readLimited(reader, maxBytes)
+		}, nil
+	case "zstd":
+		return func(body []byte) ([]byte, error) {
+			decoder, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			defer decoder.Close()
+			return readLimited(decoder, maxBytes)
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+}
+
+// readLimited reads r to the end, failing once more than maxBytes come out.
+func readLimited(r io.Reader, maxBytes int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, fmt.Errorf("decompressed body exceeds %d bytes", maxBytes)
+	}
+	return body, nil
+}
+
+// parseTemplate parses a template step once and caches it.
+func parseTemplate(text string) (*template.Template, error) {
+	if tmpl, ok := templates.Load(text); ok {
+		return tmpl.(*template.Template), nil
+	}
+	tmpl, err := template.New("transform").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	templates.Store(text, tmpl)
+	return tmpl, nil
+}
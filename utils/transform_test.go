@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"go-rabbitmq-consumers/models"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestApplyTransforms(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(`{"order":{"id":7,"items":[1,2]}}`))
+	w.Close()
+	body := []byte(base64.StdEncoding.EncodeToString(gz.Bytes()))
+
+	steps := []models.TransformStep{
+		{Type: models.TRANSFORM_BASE64_DECODE},
+		{Type: models.TRANSFORM_DECOMPRESS},
+		{Type: models.TRANSFORM_JSON_EXTRACT, Path: "order"},
+		{Type: models.TRANSFORM_TEMPLATE, Template: `{"id":{{.JSON.id}},"items":{{json .JSON.items}},"key":"{{.Metadata.RoutingKey}}"}`},
+	}
+	if err := ValidateTransforms(steps); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := &models.MessageMetadata{RoutingKey: "order.paid", ContentEncoding: "gzip"}
+	got, err := ApplyTransforms(steps, models.PayloadFormat{}, body, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"id":7,"items":[1,2],"key":"order.paid"}`; string(got) != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	_, err = ApplyTransforms(steps, models.PayloadFormat{}, []byte("not base64!"), metadata)
+	if err == nil || !strings.HasPrefix(err.Error(), "transform step 0 (base64_decode)") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	plain := bytes.Repeat([]byte("a"), 1<<20)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(plain)
+	w.Close()
+
+	encoder, _ := zstd.NewWriter(nil)
+	zst := encoder.EncodeAll(plain, nil)
+	encoder.Close()
+
+	for encoding, body := range map[string][]byte{"gzip": gz.Bytes(), "zstd": zst} {
+		metadata := &models.MessageMetadata{ContentEncoding: encoding}
+
+		steps := []models.TransformStep{{Type: models.TRANSFORM_DECOMPRESS, MaxBytes: 1 << 20}}
+		if got, err := ApplyTransforms(steps, models.PayloadFormat{}, body, metadata); err != nil || len(got) != len(plain) {
+			t.Fatalf("%s at the limit: %d bytes, %v", encoding, len(got), err)
+		}
+
+		steps[0].MaxBytes = 1<<20 - 1
+		_, err := ApplyTransforms(steps, models.PayloadFormat{}, body, metadata)
+		if err == nil || !strings.Contains(err.Error(), "exceeds") {
+			t.Fatalf("%s over the limit: unexpected error %v", encoding, err)
+		}
+	}
+}
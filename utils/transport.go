@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"net/url"
+)
+
+// transportSchemes lists the callback URL schemes each non-HTTP transport
+// accepts.
+var transportSchemes = map[string][]string{
+	models.TRANSPORT_GRPC: {"grpc", "grpcs"},
+	models.TRANSPORT_FILE: {"file"},
+	models.TRANSPORT_EXEC: {"exec"},
+	models.TRANSPORT_AMQP: {"amqp", "amqps"},
+}
+
+// ValidateTransport checks the transport of a consumer, its settings and that
+// every callback URL of the consumer suits it.
+func ValidateTransport(consumer *models.ConsumerParams) error {
+	var err error
+	switch consumer.Transport {
+	case "", models.TRANSPORT_HTTP:
+		return nil
+	case models.TRANSPORT_GRPC:
+		err = validateGrpcSettings(consumer.Grpc)
+	case models.TRANSPORT_FILE, models.TRANSPORT_EXEC, models.TRANSPORT_AMQP:
+		err = validateSinkSettings(consumer.Sink)
+	default:
+		return fmt.Errorf("unknown transport: %s", consumer.Transport)
+	}
+	if err != nil {
+		return err
+	}
+
+	urls := []string{consumer.Callback}
+	for _, target := range consumer.CallbackTargets {
+		urls = append(urls, target.URL)
+	}
+	for _, rule := range consumer.RoutingRules {
+		urls = append(urls, rule.Callback)
+	}
+	for _, callback := range urls {
+		if err := validateTransportURL(consumer.Transport, callback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateTransportURL(transport, callback string) error {
+	schemes := transportSchemes[transport]
+	u, err := url.Parse(callback)
+	if err != nil {
+		return fmt.Errorf("invalid url %s: %s", callback, err.Error())
+	}
+
+	for _, scheme := range schemes {
+		if u.Scheme != scheme {
+			continue
+		}
+		switch transport {
+		case models.TRANSPORT_GRPC, models.TRANSPORT_AMQP:
+			if u.Host == "" {
+				return fmt.Errorf("url has no host: %s", callback)
+			}
+		case models.TRANSPORT_FILE, models.TRANSPORT_EXEC:
+			if u.Host != "" || u.Path == "" {
+				return fmt.Errorf("url needs an absolute path: %s", callback)
+			}
+		}
+		switch transport {
+		case models.TRANSPORT_EXEC:
+			return checkExecSinkCommand(u.Path)
+		case models.TRANSPORT_FILE:
+			_, err := fileSinkPath(u.Path)
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("not a %s:// url: %s", schemes[0], callback)
+}
@@ -13,20 +13,45 @@ import (
 type HTTP_REQUEST_METHOD int
 
 var (
-	client *fasthttp.Client
+	client            *fasthttp.Client
+	defaultHttpClient *HttpClient
 )
 
 const (
 	HTTP_GET HTTP_REQUEST_METHOD = iota
 	HTTP_POST
+	HTTP_PUT
+	HTTP_PATCH
 )
 
+var httpMethodNames = map[HTTP_REQUEST_METHOD]string{
+	HTTP_GET:   "GET",
+	HTTP_POST:  "POST",
+	HTTP_PUT:   "PUT",
+	HTTP_PATCH: "PATCH",
+}
+
+// ParseHttpMethod maps a callback method name to its HTTP_REQUEST_METHOD. An
+// empty name means POST.
+func ParseHttpMethod(name string) (HTTP_REQUEST_METHOD, error) {
+	if name == "" {
+		return HTTP_POST, nil
+	}
+	for method, methodName := range httpMethodNames {
+		if methodName == strings.ToUpper(name) {
+			return method, nil
+		}
+	}
+	return HTTP_POST, fmt.Errorf("unsupported http method: %s", name)
+}
+
 func init() {
 	client = &fasthttp.Client{
 		ReadTimeout:  time.Second * 10,
 		WriteTimeout: time.Second * 10,
 		// MaxIdleConnDuration: 1 * time.Hour,
 	}
+	defaultHttpClient = &HttpClient{client: client}
 }
 
 func GetUUID() string {
@@ -35,48 +60,51 @@ func GetUUID() string {
 	return uuid
 }
 
+// HttpRequest sends a request with the shared default client.
 func HttpRequest(method HTTP_REQUEST_METHOD, headers map[string]string, url, body string) (string, error, int) {
+	return defaultHttpClient.Request(method, headers, url, body)
+}
+
+// Request sends a request with the client. The returned error is only set when
+// no response was received.
+func (c *HttpClient) Request(method HTTP_REQUEST_METHOD, headers map[string]string, url, body string) (string, error, int) {
 	var (
-		httpMethod string
 		err        error
 		statusCode int
 	)
-	if method == HTTP_GET {
-		httpMethod = "GET"
-	} else {
-		httpMethod = "POST"
-	}
 
 	req := fasthttp.AcquireRequest()
 
 	defer fasthttp.ReleaseRequest(req)
 
-	req.Header.SetMethod(httpMethod)
+	req.Header.SetMethod(httpMethodNames[method])
 	req.Header.Add("content-type", "application/json")
 	req.Header.Add("vinehoo-client", types.HEADER_VINEHOO_CLIENT)
 	req.Header.Add("vinehoo-client-version", types.HEADER_CLIENT_VERSION)
 
+	// Custom headers replace the defaults above, e.g. a different content-type
 	for k, v := range headers {
-		req.Header.Add(k, v)
+		req.Header.Set(k, v)
 	}
 
 	req.SetRequestURI(url)
-	if method == HTTP_POST {
+	if method != HTTP_GET {
 		req.SetBodyString(body)
 	}
+	if c.profile.DisableKeepAlive {
+		req.SetConnectionClose()
+	}
 
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseResponse(resp)
 
-	err = client.Do(req, resp)
+	err = c.client.Do(req, resp)
 	if err != nil {
 		return "", err, 0
 	}
 
+	// Whether the status code means success is up to the consumer's success criteria
 	statusCode = resp.StatusCode()
-	if statusCode != 200 {
-		return "", fmt.Errorf("http status code: %d", statusCode), statusCode
-	}
 
 	return string(resp.Body()), nil, statusCode
 }
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"fmt"
+	"go-rabbitmq-consumers/models"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// MAX_WINDOW_DURATION bounds how long one active window stays open.
+const MAX_WINDOW_DURATION = 7 * 24 * time.Hour
+
+// maxWindowSteps bounds the walk over window starts, which only gets long for
+// windows that open every minute and stay open for days.
+const maxWindowSteps = 20000
+
+// activeWindow is a parsed models.ActiveWindow.
+type activeWindow struct {
+	start    cron.Schedule
+	duration time.Duration
+}
+
+// ActiveWindowsEnabled tells whether a consumer only consumes in windows.
+func ActiveWindowsEnabled(windows models.ActiveWindows) bool {
+	return len(windows.Windows) > 0
+}
+
+func parseActiveWindows(windows models.ActiveWindows) ([]activeWindow, *time.Location, error) {
+	location, err := time.LoadLocation(windows.Timezone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unknown timezone: %s", windows.Timezone)
+	}
+
+	parsed := make([]activeWindow, len(windows.Windows))
+	for i, window := range windows.Windows {
+		start, err := cron.ParseStandard(window.Start)
+		if err != nil {
+			return nil, nil, fmt.Errorf("window %d start: %s", i, err.Error())
+		}
+		duration, err := time.ParseDuration(window.Duration)
+		if err != nil || duration <= 0 || duration > MAX_WINDOW_DURATION {
+			return nil, nil, fmt.Errorf("window %d duration must be between 0 and %s", i, MAX_WINDOW_DURATION)
+		}
+		parsed[i] = activeWindow{start: start, duration: duration}
+	}
+	return parsed, location, nil
+}
+
+// ValidateActiveWindows checks the cron specs, durations and timezone.
+func ValidateActiveWindows(windows models.ActiveWindows) error {
+	_, _, err := parseActiveWindows(windows)
+	return err
+}
+
+// coveredUntil returns when the window that covers t closes, if one does. The
+// window starting exactly at t covers it.
+func (w activeWindow) coveredUntil(t time.Time) (time.Time, bool) {
+	var end time.Time
+	// Next is strictly after its argument, step back a second to see a
+	// window opening at the start of the range.
+	start := w.start.Next(t.Add(-w.duration - time.Second))
+	for i := 0; i < maxWindowSteps && !start.IsZero() && !start.After(t); i++ {
+		if e := start.Add(w.duration); e.After(t) {
+			end = e
+		}
+		start = w.start.Next(start)
+	}
+	return end, !end.IsZero()
+}
+
+// ActiveWindowState tells whether now falls into one of the active windows,
+// and when that changes next. Overlapping and back to back windows count as
+// one. A zero next time means it never changes.
+func ActiveWindowState(windows models.ActiveWindows, now time.Time) (bool, time.Time, error) {
+	if !ActiveWindowsEnabled(windows) {
+		return true, time.Time{}, nil
+	}
+	parsed, location, err := parseActiveWindows(windows)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	now = now.In(location)
+
+	// Open: follow the windows until none covers the end of the last one.
+	end, active := now, false
+	for i := 0; i < maxWindowSteps; i++ {
+		extended := false
+		for _, w := range parsed {
+			if e, ok := w.coveredUntil(end); ok && e.After(end) {
+				end, extended = e, true
+			}
+		}
+		if !extended {
+			break
+		}
+		active = true
+	}
+	if active {
+		return true, end, nil
+	}
+
+	// Closed: the next window to open.
+	var next time.Time
+	for _, w := range parsed {
+		if start := w.start.Next(now); !start.IsZero() && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+	}
+	return false, next, nil
+}
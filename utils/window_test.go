@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"go-rabbitmq-consumers/models"
+	"testing"
+	"time"
+)
+
+func TestActiveWindowState(t *testing.T) {
+	// Weeknights from 20:00 to 06:00 plus a second window up to 08:00 on
+	// Saturday morning, in Berlin time.
+	windows := models.ActiveWindows{
+		Timezone: "Europe/Berlin",
+		Windows: []models.ActiveWindow{
+			{Start: "0 20 * * 1-5", Duration: "10h"},
+			{Start: "0 6 * * 6", Duration: "2h"},
+		},
+	}
+	if err := ValidateActiveWindows(windows); err != nil {
+		t.Fatal(err)
+	}
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	at := func(day, hour, minute int) time.Time {
+		// 2024-03-04 is a Monday.
+		return time.Date(2024, 3, 4+day, hour, minute, 0, 0, berlin)
+	}
+
+	tests := []struct {
+		name   string
+		now    time.Time
+		active bool
+		next   time.Time
+	}{
+		{"monday noon", at(0, 12, 0), false, at(0, 20, 0)},
+		{"window opens", at(0, 20, 0), true, at(1, 6, 0)},
+		{"tuesday night", at(1, 23, 30), true, at(2, 6, 0)},
+		{"window closed", at(2, 6, 0), false, at(2, 20, 0)},
+		{"friday night runs into saturday", at(4, 22, 0), true, at(5, 8, 0)},
+		{"weekend", at(5, 12, 0), false, at(7, 20, 0)},
+		{"utc input", at(0, 21, 0).UTC(), true, at(1, 6, 0)},
+	}
+	for _, tt := range tests {
+		active, next, err := ActiveWindowState(windows, tt.now)
+		if err != nil || active != tt.active || !next.Equal(tt.next) {
+			t.Errorf("%s: got %v, %s, %v", tt.name, active, next, err)
+		}
+	}
+
+	for _, invalid := range []models.ActiveWindows{
+		{Timezone: "Mars/Olympus", Windows: windows.Windows},
+		{Windows: []models.ActiveWindow{{Start: "0 25 * * *", Duration: "1h"}}},
+		{Windows: []models.ActiveWindow{{Start: "0 20 * * *", Duration: "0s"}}},
+	} {
+		if ValidateActiveWindows(invalid) == nil {
+			t.Errorf("%+v accepted", invalid)
+		}
+	}
+}